@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -14,17 +15,68 @@ import (
 // RegisterMode is a name of register mode
 type RegisterMode string
 
-// "RegisterSingleMode", "RegisterNodeMode" and "RegisterPodMode"
+// "RegisterSingleMode", "RegisterNodeMode", "RegisterPodMode" and "RegisterCatalogMode"
 // defines correct value of `register_mode` option.
 // "RegisterSingleMode" determine correct value for `single` mode.
 // "RegisterNodeMode" determine correct value for `node` mode.
 // "RegisterNodeMode" determine correct value for `pod` mode.
+// "RegisterCatalogMode" determine correct value for `catalog` mode.
 const (
-	RegisterSingleMode RegisterMode = "single"
-	RegisterNodeMode   RegisterMode = "node"
-	RegisterPodMode    RegisterMode = "pod"
+	RegisterSingleMode  RegisterMode = "single"
+	RegisterNodeMode    RegisterMode = "node"
+	RegisterPodMode     RegisterMode = "pod"
+	RegisterCatalogMode RegisterMode = "catalog"
 )
 
+// CatalogNodeMode is a name of mode which determines how synthetic nodes are created in Consul catalog
+type CatalogNodeMode string
+
+// "CatalogNodePerNode" and "CatalogNodePerCluster" defines correct value of `catalog_node_mode` option.
+// "CatalogNodePerNode" determine correct value for `node` mode.
+// "CatalogNodePerCluster" determine correct value for `cluster` mode.
+const (
+	CatalogNodePerNode    CatalogNodeMode = "node"
+	CatalogNodePerCluster CatalogNodeMode = "cluster"
+)
+
+// HeadlessMode is a name of mode which determines how headless services are registered
+type HeadlessMode string
+
+// "HeadlessSkipMode" and "HeadlessEndpointsMode" defines correct value of `cluster_ip_headless` option.
+// "HeadlessSkipMode" determine correct value for `skip` mode.
+// "HeadlessEndpointsMode" determine correct value for `endpoints` mode.
+const (
+	HeadlessSkipMode      HeadlessMode = "skip"
+	HeadlessEndpointsMode HeadlessMode = "endpoints"
+)
+
+// NodeUnhealthyAction is a name of action which is taken for services registered for unhealthy node
+type NodeUnhealthyAction string
+
+// "NodeUnhealthyMaintenance" and "NodeUnhealthyRemove" defines correct value of `node_unhealthy_action` option.
+// "NodeUnhealthyMaintenance" determine correct value for `maintenance` action.
+// "NodeUnhealthyRemove" determine correct value for `remove` action.
+const (
+	NodeUnhealthyMaintenance NodeUnhealthyAction = "maintenance"
+	NodeUnhealthyRemove      NodeUnhealthyAction = "remove"
+)
+
+// AgentDiscoveryMode is a name of strategy which determines how Consul Agent running on Kubernetes node is found
+type AgentDiscoveryMode string
+
+// "AgentDiscoveryNodeName", "AgentDiscoveryDaemonSet" and "AgentDiscoveryInternalIP" defines correct value of `consul_agent_discovery` option.
+// "AgentDiscoveryNodeName" determine correct value for `node-name` strategy.
+// "AgentDiscoveryDaemonSet" determine correct value for `daemonset` strategy.
+// "AgentDiscoveryInternalIP" determine correct value for `internal-ip` strategy.
+const (
+	AgentDiscoveryNodeName   AgentDiscoveryMode = "node-name"
+	AgentDiscoveryDaemonSet  AgentDiscoveryMode = "daemonset"
+	AgentDiscoveryInternalIP AgentDiscoveryMode = "internal-ip"
+)
+
+// NodeAddressTypes are valid values of `node_address_types` option.
+var NodeAddressTypes = []string{"InternalIP", "ExternalIP", "Hostname"}
+
 // Config describes the attributes that are uses to create configuration structure
 type Config struct {
 	Controller *ControllerConfig
@@ -33,21 +85,51 @@ type Config struct {
 
 // ControllerConfig describes the attributes for the controller configuration
 type ControllerConfig struct {
-	ConsulAddress            string
-	ConsulPort               string
-	ConsulScheme             string
-	ConsulCAFile             string
-	ConsulCertFile           string
-	ConsulKeyFile            string
-	ConsulInsecureSkipVerify bool
-	ConsulToken              string
-	ConsulTimeout            time.Duration
-	ConsulContainerName      string
-	ConsulNodeSelector       string
-	PodLabelSelector         string
-	K8sTag                   string
-	RegisterMode             RegisterMode
-	RegisterSource           string
+	ConsulAddress                string
+	ConsulPort                   string
+	ConsulScheme                 string
+	ConsulCAFile                 string
+	ConsulCertFile               string
+	ConsulKeyFile                string
+	ConsulInsecureSkipVerify     bool
+	ConsulToken                  string
+	ConsulTimeout                time.Duration
+	ConsulClientIdleTimeout      time.Duration
+	ConsulRetries                int
+	ConsulRetryBackoff           time.Duration
+	ConsulRetryMaxBackoff        time.Duration
+	ConsulRetryMaxTotalBackoff   time.Duration
+	ConsulBreakerFailures        int
+	ConsulBreakerTimeout         time.Duration
+	ConsulContainerName          string
+	ConsulNodeSelector           string
+	PodLabelSelector             string
+	K8sTag                       string
+	RegisterMode                 RegisterMode
+	RegisterSource               string
+	RegisterClusterIP            bool
+	ClusterIPConsulAddress       string
+	ClusterIPHeadless            HeadlessMode
+	ExternalNodeName             string
+	NodeAddressTypes             []string
+	NodeUnhealthyAction          NodeUnhealthyAction
+	CatalogNodeMode              CatalogNodeMode
+	CatalogNodeName              string
+	ConsulNamespace              string
+	ConsulNamespaceMirroring     bool
+	ConsulNamespacePrefix        string
+	ConsulPartition              string
+	CleanMaxDeregistrations      int
+	CleanMaxDeregistrationsRatio float64
+	CleanOrphanMinRuns           int
+	ClusterName                  string
+	ClusterNameTag               bool
+	ConsulAgentDiscovery         AgentDiscoveryMode
+	ConsulAgentSelector          string
+	ConsulAgentNamespace         string
+	ConsulAgentAddresses         map[string]string
+	// DryRun is set by `-dry-run` flag, operations on Consul are recorded instead of executed
+	DryRun bool
 }
 
 var config = &Config{}
@@ -69,6 +151,15 @@ func Load(clientset *kubernetes.Clientset, namespace string, name string) (*Conf
 	return filledConfig, nil
 }
 
+// LoadData fills configuration from data of ConfigMap which is not read from Kubernetes cluster
+func LoadData(data map[string]string) (*Config, error) {
+	filledConfig, err := config.fillConfig(data)
+	if err != nil {
+		return config, fmt.Errorf("Can't fill configuration: %s", err)
+	}
+	return filledConfig, nil
+}
+
 func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 	//Consul configuration
 	c.Consul = consulapi.DefaultConfig()
@@ -128,6 +219,84 @@ func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 		c.Controller.ConsulTimeout = 2 * time.Second
 	}
 
+	if value, ok := data["consul_client_idle_timeout"]; ok && value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ConsulClientIdleTimeout = timeout
+	} else {
+		c.Controller.ConsulClientIdleTimeout = 10 * time.Minute
+	}
+
+	if value, ok := data["consul_retries"]; ok && value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return c, err
+		}
+		if v < 0 {
+			glog.Warningf("Wrong value of 'consul_retries' option. Value must not be negative, is %d", v)
+			v = 0
+		}
+		c.Controller.ConsulRetries = v
+	} else {
+		c.Controller.ConsulRetries = 2
+	}
+
+	if value, ok := data["consul_retry_backoff"]; ok && value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ConsulRetryBackoff = backoff
+	} else {
+		c.Controller.ConsulRetryBackoff = 200 * time.Millisecond
+	}
+
+	if value, ok := data["consul_retry_max_backoff"]; ok && value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ConsulRetryMaxBackoff = backoff
+	} else {
+		c.Controller.ConsulRetryMaxBackoff = 2 * time.Second
+	}
+
+	if value, ok := data["consul_retry_max_total_backoff"]; ok && value != "" {
+		backoff, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ConsulRetryMaxTotalBackoff = backoff
+	} else {
+		c.Controller.ConsulRetryMaxTotalBackoff = 2 * time.Second
+	}
+
+	if value, ok := data["consul_breaker_failures"]; ok && value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return c, err
+		}
+		if v < 0 {
+			glog.Warningf("Wrong value of 'consul_breaker_failures' option. Value must not be negative, is %d", v)
+			v = 0
+		}
+		c.Controller.ConsulBreakerFailures = v
+	} else {
+		c.Controller.ConsulBreakerFailures = 5
+	}
+
+	if value, ok := data["consul_breaker_timeout"]; ok && value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ConsulBreakerTimeout = timeout
+	} else {
+		c.Controller.ConsulBreakerTimeout = 30 * time.Second
+	}
+
 	if value, ok := data["consul_container_name"]; ok && value != "" {
 		c.Controller.ConsulContainerName = value
 	} else {
@@ -158,9 +327,11 @@ func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 			c.Controller.RegisterMode = RegisterNodeMode
 		case string(RegisterPodMode):
 			c.Controller.RegisterMode = RegisterPodMode
+		case string(RegisterCatalogMode):
+			c.Controller.RegisterMode = RegisterCatalogMode
 		default:
-			glog.Warningf("Wrong value of 'register_mode' option. Permitted values: %s|%s|%s, is %s",
-				RegisterSingleMode, RegisterNodeMode, RegisterPodMode, value)
+			glog.Warningf("Wrong value of 'register_mode' option. Permitted values: %s|%s|%s|%s, is %s",
+				RegisterSingleMode, RegisterNodeMode, RegisterPodMode, RegisterCatalogMode, value)
 
 			c.Controller.RegisterMode = RegisterSingleMode
 		}
@@ -174,5 +345,238 @@ func (c *Config) fillConfig(data map[string]string) (*Config, error) {
 		c.Controller.RegisterSource = "pod"
 	}
 
+	if value, ok := data["register_cluster_ip"]; ok && value != "" {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.RegisterClusterIP = v
+	} else {
+		c.Controller.RegisterClusterIP = false
+	}
+
+	if value, ok := data["cluster_ip_consul_address"]; ok && value != "" {
+		c.Controller.ClusterIPConsulAddress = value
+	} else {
+		c.Controller.ClusterIPConsulAddress = c.Controller.ConsulAddress
+	}
+
+	if value, ok := data["cluster_ip_headless"]; ok {
+		switch value {
+		case string(HeadlessSkipMode):
+			c.Controller.ClusterIPHeadless = HeadlessSkipMode
+		case string(HeadlessEndpointsMode):
+			c.Controller.ClusterIPHeadless = HeadlessEndpointsMode
+		default:
+			glog.Warningf("Wrong value of 'cluster_ip_headless' option. Permitted values: %s|%s, is %s",
+				HeadlessSkipMode, HeadlessEndpointsMode, value)
+
+			c.Controller.ClusterIPHeadless = HeadlessSkipMode
+		}
+	} else {
+		c.Controller.ClusterIPHeadless = HeadlessSkipMode
+	}
+
+	if value, ok := data["external_node_name"]; ok && value != "" {
+		c.Controller.ExternalNodeName = value
+	}
+
+	c.Controller.NodeAddressTypes = nil
+	if value, ok := data["node_address_types"]; ok && value != "" {
+		for _, addressType := range strings.Split(value, ",") {
+			addressType = strings.TrimSpace(addressType)
+			if !isNodeAddressType(addressType) {
+				glog.Warningf("Wrong value of 'node_address_types' option. Permitted values: %s, is %s",
+					strings.Join(NodeAddressTypes, "|"), addressType)
+				continue
+			}
+			c.Controller.NodeAddressTypes = append(c.Controller.NodeAddressTypes, addressType)
+		}
+	}
+	if len(c.Controller.NodeAddressTypes) == 0 {
+		c.Controller.NodeAddressTypes = NodeAddressTypes
+	}
+
+	if value, ok := data["node_unhealthy_action"]; ok {
+		switch value {
+		case string(NodeUnhealthyMaintenance):
+			c.Controller.NodeUnhealthyAction = NodeUnhealthyMaintenance
+		case string(NodeUnhealthyRemove):
+			c.Controller.NodeUnhealthyAction = NodeUnhealthyRemove
+		default:
+			glog.Warningf("Wrong value of 'node_unhealthy_action' option. Permitted values: %s|%s, is %s",
+				NodeUnhealthyMaintenance, NodeUnhealthyRemove, value)
+
+			c.Controller.NodeUnhealthyAction = NodeUnhealthyMaintenance
+		}
+	} else {
+		c.Controller.NodeUnhealthyAction = NodeUnhealthyMaintenance
+	}
+
+	if value, ok := data["catalog_node_mode"]; ok {
+		switch value {
+		case string(CatalogNodePerNode):
+			c.Controller.CatalogNodeMode = CatalogNodePerNode
+		case string(CatalogNodePerCluster):
+			c.Controller.CatalogNodeMode = CatalogNodePerCluster
+		default:
+			glog.Warningf("Wrong value of 'catalog_node_mode' option. Permitted values: %s|%s, is %s",
+				CatalogNodePerNode, CatalogNodePerCluster, value)
+
+			c.Controller.CatalogNodeMode = CatalogNodePerNode
+		}
+	} else {
+		c.Controller.CatalogNodeMode = CatalogNodePerNode
+	}
+
+	if value, ok := data["catalog_node_name"]; ok && value != "" {
+		c.Controller.CatalogNodeName = value
+	}
+
+	if value, ok := data["consul_namespace"]; ok && value != "" {
+		c.Controller.ConsulNamespace = value
+	}
+
+	if value, ok := data["consul_namespace_mirroring"]; ok && value != "" {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ConsulNamespaceMirroring = v
+	} else {
+		c.Controller.ConsulNamespaceMirroring = false
+	}
+
+	if value, ok := data["consul_namespace_mirroring_prefix"]; ok && value != "" {
+		c.Controller.ConsulNamespacePrefix = value
+	}
+
+	if value, ok := data["consul_partition"]; ok && value != "" {
+		c.Controller.ConsulPartition = value
+	}
+
+	if value, ok := data["clean_max_deregistrations"]; ok && value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return c, err
+		}
+		if v < 0 {
+			glog.Warningf("Wrong value of 'clean_max_deregistrations' option. Value must not be negative, is %d", v)
+			v = 0
+		}
+		c.Controller.CleanMaxDeregistrations = v
+	} else {
+		c.Controller.CleanMaxDeregistrations = 0
+	}
+
+	if value, ok := data["clean_max_deregistrations_ratio"]; ok && value != "" {
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return c, err
+		}
+		if v < 0 || v > 1 {
+			glog.Warningf("Wrong value of 'clean_max_deregistrations_ratio' option. Value must be between 0 and 1, is %v", v)
+			v = 0
+		}
+		c.Controller.CleanMaxDeregistrationsRatio = v
+	} else {
+		c.Controller.CleanMaxDeregistrationsRatio = 0
+	}
+
+	if value, ok := data["clean_orphan_min_runs"]; ok && value != "" {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return c, err
+		}
+		if v < 1 {
+			glog.Warningf("Wrong value of 'clean_orphan_min_runs' option. Value must be greater than 0, is %d", v)
+			v = 1
+		}
+		c.Controller.CleanOrphanMinRuns = v
+	} else {
+		c.Controller.CleanOrphanMinRuns = 1
+	}
+
+	if value, ok := data["cluster_name"]; ok && value != "" {
+		c.Controller.ClusterName = value
+	}
+
+	// The default external and synthetic nodes are distinct in every cluster which shares Consul datacenter
+	if c.Controller.ExternalNodeName == "" {
+		c.Controller.ExternalNodeName = "kubernetes-external"
+		if c.Controller.ClusterName != "" {
+			c.Controller.ExternalNodeName = fmt.Sprintf("kubernetes-external-%s", c.Controller.ClusterName)
+		}
+	}
+	if c.Controller.CatalogNodeName == "" {
+		c.Controller.CatalogNodeName = "kubernetes"
+		if c.Controller.ClusterName != "" {
+			c.Controller.CatalogNodeName = fmt.Sprintf("kubernetes-%s", c.Controller.ClusterName)
+		}
+	}
+
+	if value, ok := data["cluster_name_tag"]; ok && value != "" {
+		v, err := strconv.ParseBool(value)
+		if err != nil {
+			return c, err
+		}
+		c.Controller.ClusterNameTag = v
+	} else {
+		c.Controller.ClusterNameTag = false
+	}
+
+	if value, ok := data["consul_agent_discovery"]; ok {
+		switch value {
+		case string(AgentDiscoveryNodeName):
+			c.Controller.ConsulAgentDiscovery = AgentDiscoveryNodeName
+		case string(AgentDiscoveryDaemonSet):
+			c.Controller.ConsulAgentDiscovery = AgentDiscoveryDaemonSet
+		case string(AgentDiscoveryInternalIP):
+			c.Controller.ConsulAgentDiscovery = AgentDiscoveryInternalIP
+		default:
+			glog.Warningf("Wrong value of 'consul_agent_discovery' option. Permitted values: %s|%s|%s, is %s",
+				AgentDiscoveryNodeName, AgentDiscoveryDaemonSet, AgentDiscoveryInternalIP, value)
+
+			c.Controller.ConsulAgentDiscovery = AgentDiscoveryNodeName
+		}
+	} else {
+		c.Controller.ConsulAgentDiscovery = AgentDiscoveryNodeName
+	}
+
+	if value, ok := data["consul_agent_selector"]; ok && value != "" {
+		c.Controller.ConsulAgentSelector = value
+	} else {
+		c.Controller.ConsulAgentSelector = "app=consul,component=client"
+	}
+
+	if value, ok := data["consul_agent_namespace"]; ok && value != "" {
+		c.Controller.ConsulAgentNamespace = value
+	}
+
+	c.Controller.ConsulAgentAddresses = make(map[string]string)
+	if value, ok := data["consul_agent_addresses"]; ok && value != "" {
+		for _, entry := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' }) {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			nodeAddress := strings.SplitN(entry, "=", 2)
+			if len(nodeAddress) != 2 || strings.TrimSpace(nodeAddress[0]) == "" || strings.TrimSpace(nodeAddress[1]) == "" {
+				glog.Warningf("Wrong value of 'consul_agent_addresses' option. Permitted format: node=address, is %s", entry)
+				continue
+			}
+			c.Controller.ConsulAgentAddresses[strings.TrimSpace(nodeAddress[0])] = strings.TrimSpace(nodeAddress[1])
+		}
+	}
+
 	return c, nil
 }
+
+func isNodeAddressType(value string) bool {
+	for _, addressType := range NodeAddressTypes {
+		if value == addressType {
+			return true
+		}
+	}
+	return false
+}
@@ -41,11 +41,39 @@ func TestFillConfigDefaults(t *testing.T) {
 	assert.Equal(t, cfg.Controller.ConsulInsecureSkipVerify, false, "wrong default value for `consul_insecure_skip_verify` option")
 	assert.Equal(t, cfg.Controller.ConsulToken, "", "wrong default value for `consul_token` option")
 	assert.Equal(t, cfg.Controller.ConsulTimeout, 2*time.Second, "wrong default value for `consul_timeout` option")
+	assert.Equal(t, cfg.Controller.ConsulClientIdleTimeout, 10*time.Minute, "wrong default value for `consul_client_idle_timeout` option")
+	assert.Equal(t, cfg.Controller.ConsulRetries, 2, "wrong default value for `consul_retries` option")
+	assert.Equal(t, cfg.Controller.ConsulRetryBackoff, 200*time.Millisecond, "wrong default value for `consul_retry_backoff` option")
+	assert.Equal(t, cfg.Controller.ConsulRetryMaxBackoff, 2*time.Second, "wrong default value for `consul_retry_max_backoff` option")
+	assert.Equal(t, cfg.Controller.ConsulRetryMaxTotalBackoff, 2*time.Second, "wrong default value for `consul_retry_max_total_backoff` option")
+	assert.Equal(t, cfg.Controller.ConsulBreakerFailures, 5, "wrong default value for `consul_breaker_failures` option")
+	assert.Equal(t, cfg.Controller.ConsulBreakerTimeout, 30*time.Second, "wrong default value for `consul_breaker_timeout` option")
 	assert.Equal(t, cfg.Controller.ConsulContainerName, "consul", "wrong default value for `consul_container_name` option")
 	assert.Equal(t, cfg.Controller.ConsulNodeSelector, "consul=enabled", "wrong default value for `consul_node_selector` option")
 	assert.Equal(t, cfg.Controller.PodLabelSelector, "", "wrong default value for `pod_label_selector` option")
 	assert.Equal(t, cfg.Controller.K8sTag, "kubernetes", "wrong default value for `k8s_tag` option")
 	assert.Equal(t, cfg.Controller.RegisterMode, RegisterSingleMode, "wrong default value for `register_mode` option")
+	assert.Equal(t, cfg.Controller.RegisterClusterIP, false, "wrong default value for `register_cluster_ip` option")
+	assert.Equal(t, cfg.Controller.ClusterIPConsulAddress, "localhost", "wrong default value for `cluster_ip_consul_address` option")
+	assert.Equal(t, cfg.Controller.ClusterIPHeadless, HeadlessSkipMode, "wrong default value for `cluster_ip_headless` option")
+	assert.Equal(t, cfg.Controller.ExternalNodeName, "kubernetes-external", "wrong default value for `external_node_name` option")
+	assert.Equal(t, cfg.Controller.NodeAddressTypes, []string{"InternalIP", "ExternalIP", "Hostname"}, "wrong default value for `node_address_types` option")
+	assert.Equal(t, cfg.Controller.NodeUnhealthyAction, NodeUnhealthyMaintenance, "wrong default value for `node_unhealthy_action` option")
+	assert.Equal(t, cfg.Controller.CatalogNodeMode, CatalogNodePerNode, "wrong default value for `catalog_node_mode` option")
+	assert.Equal(t, cfg.Controller.CatalogNodeName, "kubernetes", "wrong default value for `catalog_node_name` option")
+	assert.Equal(t, cfg.Controller.ConsulNamespace, "", "wrong default value for `consul_namespace` option")
+	assert.Equal(t, cfg.Controller.ConsulNamespaceMirroring, false, "wrong default value for `consul_namespace_mirroring` option")
+	assert.Equal(t, cfg.Controller.ConsulNamespacePrefix, "", "wrong default value for `consul_namespace_mirroring_prefix` option")
+	assert.Equal(t, cfg.Controller.ConsulPartition, "", "wrong default value for `consul_partition` option")
+	assert.Equal(t, cfg.Controller.CleanMaxDeregistrations, 0, "wrong default value for `clean_max_deregistrations` option")
+	assert.Equal(t, cfg.Controller.CleanMaxDeregistrationsRatio, float64(0), "wrong default value for `clean_max_deregistrations_ratio` option")
+	assert.Equal(t, cfg.Controller.CleanOrphanMinRuns, 1, "wrong default value for `clean_orphan_min_runs` option")
+	assert.Equal(t, cfg.Controller.ClusterName, "", "wrong default value for `cluster_name` option")
+	assert.Equal(t, cfg.Controller.ClusterNameTag, false, "wrong default value for `cluster_name_tag` option")
+	assert.Equal(t, cfg.Controller.ConsulAgentDiscovery, AgentDiscoveryNodeName, "wrong default value for `consul_agent_discovery` option")
+	assert.Equal(t, cfg.Controller.ConsulAgentSelector, "app=consul,component=client", "wrong default value for `consul_agent_selector` option")
+	assert.Equal(t, cfg.Controller.ConsulAgentNamespace, "", "wrong default value for `consul_agent_namespace` option")
+	assert.Equal(t, cfg.Controller.ConsulAgentAddresses, map[string]string{}, "wrong default value for `consul_agent_addresses` option")
 }
 
 func TestFillConfig(t *testing.T) {
@@ -64,11 +92,39 @@ func TestFillConfig(t *testing.T) {
 	data["consul_insecure_skip_verify"] = "true"
 	data["consul_token"] = "token"
 	data["consul_timeout"] = "10s"
+	data["consul_client_idle_timeout"] = "1m"
+	data["consul_retries"] = "3"
+	data["consul_retry_backoff"] = "1s"
+	data["consul_retry_max_backoff"] = "10s"
+	data["consul_retry_max_total_backoff"] = "5s"
+	data["consul_breaker_failures"] = "0"
+	data["consul_breaker_timeout"] = "1m"
 	data["consul_container_name"] = "name"
 	data["consul_node_selector"] = "selector=true"
 	data["pod_label_selector"] = "app=mycrazyapp"
 	data["k8s_tag"] = "k8s"
 	data["register_mode"] = "node"
+	data["register_cluster_ip"] = "true"
+	data["cluster_ip_consul_address"] = "consul.service"
+	data["cluster_ip_headless"] = "endpoints"
+	data["external_node_name"] = "k8s-external"
+	data["node_address_types"] = "ExternalIP, Hostname,Wrong"
+	data["node_unhealthy_action"] = "remove"
+	data["catalog_node_mode"] = "cluster"
+	data["catalog_node_name"] = "k8s"
+	data["consul_namespace"] = "team"
+	data["consul_namespace_mirroring"] = "true"
+	data["consul_namespace_mirroring_prefix"] = "k8s-"
+	data["consul_partition"] = "part"
+	data["clean_max_deregistrations"] = "10"
+	data["clean_max_deregistrations_ratio"] = "0.5"
+	data["clean_orphan_min_runs"] = "3"
+	data["cluster_name"] = "prod"
+	data["cluster_name_tag"] = "true"
+	data["consul_agent_discovery"] = "daemonset"
+	data["consul_agent_selector"] = "app=consul-agent"
+	data["consul_agent_namespace"] = "consul"
+	data["consul_agent_addresses"] = "node1=10.0.0.1:8501, node2=https://agent:8501\nwrong"
 
 	cfg.fillConfig(data)
 
@@ -81,11 +137,45 @@ func TestFillConfig(t *testing.T) {
 	assert.Equal(t, cfg.Controller.ConsulInsecureSkipVerify, true, "they should be equal")
 	assert.Equal(t, cfg.Controller.ConsulToken, "token", "they should be equal")
 	assert.Equal(t, cfg.Controller.ConsulTimeout, time.Duration(10*time.Second), "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulClientIdleTimeout, time.Duration(1*time.Minute), "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulRetries, 3, "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulRetryBackoff, time.Duration(1*time.Second), "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulRetryMaxBackoff, time.Duration(10*time.Second), "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulRetryMaxTotalBackoff, time.Duration(5*time.Second), "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulBreakerFailures, 0, "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulBreakerTimeout, time.Duration(1*time.Minute), "they should be equal")
 	assert.Equal(t, cfg.Controller.ConsulContainerName, "name", "they should be equal")
 	assert.Equal(t, cfg.Controller.ConsulNodeSelector, "selector=true", "they should be equal")
 	assert.Equal(t, cfg.Controller.PodLabelSelector, "app=mycrazyapp", "they should be equal")
 	assert.Equal(t, cfg.Controller.K8sTag, "k8s", "they should be equal")
 	assert.Equal(t, cfg.Controller.RegisterMode, RegisterNodeMode, "they should be equal")
+	assert.Equal(t, cfg.Controller.RegisterClusterIP, true, "they should be equal")
+	assert.Equal(t, cfg.Controller.ClusterIPConsulAddress, "consul.service", "they should be equal")
+	assert.Equal(t, cfg.Controller.ClusterIPHeadless, HeadlessEndpointsMode, "they should be equal")
+	assert.Equal(t, cfg.Controller.ExternalNodeName, "k8s-external", "they should be equal")
+	assert.Equal(t, cfg.Controller.NodeAddressTypes, []string{"ExternalIP", "Hostname"}, "they should be equal")
+	assert.Equal(t, cfg.Controller.NodeUnhealthyAction, NodeUnhealthyRemove, "they should be equal")
+	assert.Equal(t, cfg.Controller.CatalogNodeMode, CatalogNodePerCluster, "they should be equal")
+	assert.Equal(t, cfg.Controller.CatalogNodeName, "k8s", "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulNamespace, "team", "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulNamespaceMirroring, true, "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulNamespacePrefix, "k8s-", "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulPartition, "part", "they should be equal")
+	assert.Equal(t, cfg.Controller.CleanMaxDeregistrations, 10, "they should be equal")
+	assert.Equal(t, cfg.Controller.CleanMaxDeregistrationsRatio, 0.5, "they should be equal")
+	assert.Equal(t, cfg.Controller.CleanOrphanMinRuns, 3, "they should be equal")
+	assert.Equal(t, cfg.Controller.ClusterName, "prod", "they should be equal")
+	assert.Equal(t, cfg.Controller.ClusterNameTag, true, "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulAgentDiscovery, AgentDiscoveryDaemonSet, "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulAgentSelector, "app=consul-agent", "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulAgentNamespace, "consul", "they should be equal")
+	assert.Equal(t, cfg.Controller.ConsulAgentAddresses, map[string]string{"node1": "10.0.0.1:8501", "node2": "https://agent:8501"}, "they should be equal")
+
+	delete(data, "external_node_name")
+	delete(data, "catalog_node_name")
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.ExternalNodeName, "kubernetes-external-prod", "default external node should be distinct in every cluster")
+	assert.Equal(t, cfg.Controller.CatalogNodeName, "kubernetes-prod", "default synthetic node should be distinct in every cluster")
 
 	data["register_mode"] = "pod"
 	cfg.fillConfig(data)
@@ -99,6 +189,10 @@ func TestFillConfig(t *testing.T) {
 	cfg.fillConfig(data)
 	assert.Equal(t, cfg.Controller.RegisterMode, RegisterNodeMode, "they should be equal")
 
+	data["register_mode"] = "catalog"
+	cfg.fillConfig(data)
+	assert.Equal(t, cfg.Controller.RegisterMode, RegisterCatalogMode, "they should be equal")
+
 	data["consul_insecure_skip_verify"] = "not_bool"
 	_, err := cfg.fillConfig(data)
 	assert.Error(t, err, "An error was expected")
@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"github.com/golang/glog"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/metrics"
+	"github.com/tczekajlo/kube-consul-register/utils"
+)
+
+// OrphanedServices returns services which can be deregistered during cleaning. Service is orphaned
+// when it's been missing in Kubernetes in `clean_orphan_min_runs` consecutive runs. No service is orphaned
+// when the number of orphaned services exceeds the limit of deregistrations, source is the label
+// of the metric of exceeded limit, e.g. `service`, `pod`, `endpoints` or `node` for synthetic nodes.
+// Missing services which can't be deregistered yet are returned as held.
+func OrphanedServices(cfg *config.Config, source string, tracker utils.Orphans, missing []string, total int) ([]string, []string) {
+	orphaned := tracker.Update(missing, cfg.Controller.CleanOrphanMinRuns)
+	if utils.IsDeregistrationLimitExceeded(len(orphaned), total,
+		cfg.Controller.CleanMaxDeregistrations, cfg.Controller.CleanMaxDeregistrationsRatio) {
+		glog.Errorf("Cleaning has been stopped, %d of %d objects of %s source would be deregistered which exceeds the limit of deregistrations",
+			len(orphaned), total, source)
+		metrics.CleanLimitExceeded.WithLabelValues(source).Inc()
+		return nil, missing
+	}
+
+	var isOrphaned = make(map[string]bool)
+	for _, serviceID := range orphaned {
+		isOrphaned[serviceID] = true
+	}
+	var held []string
+	for _, serviceID := range missing {
+		if !isOrphaned[serviceID] {
+			held = append(held, serviceID)
+		}
+	}
+	return orphaned, held
+}
+
+// CleanInactiveNodes deregisters synthetic nodes of Kubernetes nodes which don't exist anymore,
+// nodes which Consul Agents have been cached for are active. Deregistration of node removes all its
+// services, so inactive nodes are subject to the same limits of cleaning as services, tracker counts
+// consecutive runs in which nodes have been inactive.
+func (c *Adapter) CleanInactiveNodes(cfg *config.Config, tracker utils.Orphans, consulAgents map[string]*Adapter) {
+	consulAgent := c.New(cfg, "", "")
+	nodes, err := consulAgent.CatalogNodes()
+	if err != nil {
+		glog.Errorf("Can't clean nodes in Consul catalog: %s", err)
+		return
+	}
+
+	var inactive []string
+	for _, node := range nodes {
+		if _, ok := consulAgents[node]; !ok {
+			inactive = append(inactive, node)
+		}
+	}
+
+	orphaned, held := OrphanedServices(cfg, "node", tracker, inactive, len(nodes))
+	for _, node := range held {
+		consulAgent.Hold(node, nil)
+	}
+	for _, node := range orphaned {
+		err := consulAgent.CatalogDeregisterNode(node)
+		if err != nil {
+			glog.Errorf("Can't deregister node %s from catalog: %s", node, err)
+		}
+	}
+}
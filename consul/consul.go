@@ -1,31 +1,101 @@
 package consul
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
-	"net/url"
+	"net"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/utils"
 
 	"github.com/golang/glog"
 	consulapi "github.com/hashicorp/consul/api"
-	cleanhttp "github.com/hashicorp/go-cleanhttp"
 )
 
+// CatalogNodeMetaKey is a key of node meta which marks synthetic nodes created in `catalog` mode
+const CatalogNodeMetaKey = "kube-consul-register"
+
+// ClusterMetaKey is a key of service meta and node meta which contains the name of Kubernetes cluster owning them
+const ClusterMetaKey = "k8s-cluster"
+
+// SidecarServiceID returns ID of Connect sidecar proxy service registered together with service with given ID
+func SidecarServiceID(serviceID string) string {
+	return fmt.Sprintf("%s-sidecar-proxy", serviceID)
+}
+
+// AgentResolver finds address of Consul Agent running on Kubernetes node, as host, host:port or URL
+type AgentResolver interface {
+	AgentAddress(nodeName string) (string, bool)
+}
+
+// NodeResolver finds IP address of Kubernetes node
+type NodeResolver interface {
+	NodeAddress(nodeName string) (string, bool)
+}
+
 // Adapter builds configuration and returns Consul Client
 type Adapter struct {
 	client *consulapi.Client
 	Config *consulapi.Config
+	// Resolver finds Consul Agent of node in `node` and `pod` mode
+	Resolver AgentResolver
+	// NodeResolver finds address of synthetic node of Kubernetes node in `catalog` mode
+	NodeResolver NodeResolver
+	// catalogNode is a name of node in Consul catalog which services are registered on in `catalog` mode
+	catalogNode string
+	// namespaceMirroring lists services from all Consul namespaces
+	namespaceMirroring bool
+	// serviceNamespaces keeps Consul namespaces of services returned by the last listing
+	serviceNamespaces map[string]string
+	// dryRun records operations which change Consul instead of executing them
+	dryRun bool
+	// clusterName is a name of Kubernetes cluster which owns synthetic nodes in `catalog` mode and the external node
+	clusterName string
+	// retry describes retries of failed requests and circuit breaker of Consul Agent
+	retry retryPolicy
+}
+
+// Namespace returns Consul namespace which services from given Kubernetes namespace are registered in.
+// Empty value means the default namespace of Consul Agent.
+func Namespace(cfg *config.Config, namespace string) string {
+	if cfg.Controller.ConsulNamespaceMirroring {
+		return cfg.Controller.ConsulNamespacePrefix + namespace
+	}
+	return cfg.Controller.ConsulNamespace
+}
+
+// SetOwner marks service as owned by Kubernetes cluster given in `cluster_name` option
+func SetOwner(cfg *config.Config, service *consulapi.AgentServiceRegistration) {
+	if cfg.Controller.ClusterName == "" {
+		return
+	}
+	if service.Meta == nil {
+		service.Meta = make(map[string]string)
+	}
+	service.Meta[ClusterMetaKey] = cfg.Controller.ClusterName
+	if cfg.Controller.ClusterNameTag {
+		service.Tags = append(service.Tags, fmt.Sprintf("cluster:%s", cfg.Controller.ClusterName))
+	}
+}
+
+// IsOwned checks whether service with given tags and meta is tagged with `k8s_tag` and,
+// if `cluster_name` option is set, whether it's owned by the cluster.
+func IsOwned(cfg *config.Config, tags []string, meta map[string]string) bool {
+	if !utils.CheckK8sTag(tags, cfg.Controller.K8sTag) {
+		return false
+	}
+	if cfg.Controller.ClusterName == "" {
+		return true
+	}
+	return meta[ClusterMetaKey] == cfg.Controller.ClusterName
 }
 
 // New returns the ConsulAdapter.
 func (c *Adapter) New(cfg *config.Config, podNodeName string, podIP string) *Adapter {
 	var address string
-	var err error
-	var uri *url.URL
-	var tlsConfig *tls.Config
 
 	//Build URI
 	switch mode := cfg.Controller.RegisterMode; mode {
@@ -33,81 +103,614 @@ func (c *Adapter) New(cfg *config.Config, podNodeName string, podIP string) *Ada
 		address = fmt.Sprintf("%s://%s:%s",
 			cfg.Controller.ConsulScheme, cfg.Controller.ConsulAddress, cfg.Controller.ConsulPort)
 	case config.RegisterNodeMode:
-		address = fmt.Sprintf("%s://%s:%s",
-			cfg.Controller.ConsulScheme, podNodeName, cfg.Controller.ConsulPort)
+		address = c.agentAddress(cfg, podNodeName, podNodeName)
 	case config.RegisterPodMode:
+		address = c.agentAddress(cfg, podNodeName, podIP)
+	case config.RegisterCatalogMode:
 		address = fmt.Sprintf("%s://%s:%s",
-			cfg.Controller.ConsulScheme, podIP, cfg.Controller.ConsulPort)
-	}
-
-	uri, err = url.Parse(address)
-	if err != nil {
-		glog.Fatalf("bad adapter uri: ")
+			cfg.Controller.ConsulScheme, cfg.Controller.ConsulAddress, cfg.Controller.ConsulPort)
 	}
 
-	switch uri.Scheme {
-	case "consul-unix":
-		cfg.Consul.Address = strings.TrimPrefix(uri.String(), "consul-")
+	adapter := c.newFromAddress(cfg, address)
 
-	case "https":
-		tlsConfigDesc := &consulapi.TLSConfig{
-			Address:            uri.Host,
-			CAFile:             cfg.Controller.ConsulCAFile,
-			CertFile:           cfg.Controller.ConsulCertFile,
-			KeyFile:            cfg.Controller.ConsulKeyFile,
-			InsecureSkipVerify: cfg.Controller.ConsulInsecureSkipVerify,
-		}
-		tlsConfig, err = consulapi.SetupTLSConfig(tlsConfigDesc)
-		if err != nil {
-			glog.Fatalf("Cannot set up Consul TLSConfig: %s", err)
-		}
-		cfg.Consul.Scheme = uri.Scheme
-		transport := cleanhttp.DefaultPooledTransport()
-		transport.TLSClientConfig = tlsConfig
-		cfg.Consul.HttpClient = &http.Client{
-			Transport: transport,
+	// In catalog mode services are registered on synthetic node per Kubernetes node,
+	// or on one node per cluster
+	if cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		adapter.catalogNode = cfg.Controller.CatalogNodeName
+		if cfg.Controller.CatalogNodeMode == config.CatalogNodePerNode && podNodeName != "" {
+			adapter.catalogNode = podNodeName
 		}
-		cfg.Consul.Address = uri.Host
+	}
+	return adapter
+}
 
-	default:
-		cfg.Consul.HttpClient = &http.Client{}
-		cfg.Consul.Address = uri.Host
+// agentAddress returns URL of Consul Agent running on Kubernetes node with given name. Address from
+// `consul_agent_addresses` option takes precedence over the one found by resolver, if the agent
+// isn't found then the default host is used.
+func (c *Adapter) agentAddress(cfg *config.Config, nodeName string, defaultHost string) string {
+	if address, ok := cfg.Controller.ConsulAgentAddresses[nodeName]; ok && nodeName != "" {
+		return agentURL(cfg, address)
 	}
+	if c.Resolver != nil && nodeName != "" {
+		if address, ok := c.Resolver.AgentAddress(nodeName); ok {
+			return agentURL(cfg, address)
+		}
+	}
+	return fmt.Sprintf("%s://%s:%s", cfg.Controller.ConsulScheme, defaultHost, cfg.Controller.ConsulPort)
+}
 
-	// Add Token
-	if cfg.Controller.ConsulToken != "" {
-		cfg.Consul.Token = cfg.Controller.ConsulToken
+// agentURL returns URL of Consul Agent from address given as host, host:port or URL,
+// scheme and port are taken from configuration if missing
+func agentURL(cfg *config.Config, address string) string {
+	if strings.Contains(address, "://") {
+		return address
 	}
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return fmt.Sprintf("%s://%s", cfg.Controller.ConsulScheme, address)
+	}
+	return fmt.Sprintf("%s://%s:%s", cfg.Controller.ConsulScheme, address, cfg.Controller.ConsulPort)
+}
 
-	//Timeout
-	cfg.Consul.HttpClient.Timeout = cfg.Controller.ConsulTimeout
+// NewForAgent returns the ConsulAdapter for Consul Agent with given host regardless of register mode.
+func (c *Adapter) NewForAgent(cfg *config.Config, host string) *Adapter {
+	address := fmt.Sprintf("%s://%s:%s",
+		cfg.Controller.ConsulScheme, host, cfg.Controller.ConsulPort)
 
-	client, err := consulapi.NewClient(cfg.Consul)
-	if err != nil {
-		glog.Fatalf("consul: %s", uri.Scheme)
+	return c.newFromAddress(cfg, address)
+}
+
+// NewForNode returns the ConsulAdapter for Consul Agent running on Kubernetes node with given name.
+// In `node` and `pod` register modes the host, e.g. address of node, is used if address of the agent
+// isn't given by `consul_agent_addresses` option or found by resolver.
+func (c *Adapter) NewForNode(cfg *config.Config, nodeName string, host string) *Adapter {
+	switch cfg.Controller.RegisterMode {
+	case config.RegisterNodeMode, config.RegisterPodMode:
+		return c.newFromAddress(cfg, c.agentAddress(cfg, nodeName, host))
 	}
+	return c.New(cfg, nodeName, host)
+}
 
-	//Store config
-	c.Config = cfg.Consul
+func (c *Adapter) newFromAddress(cfg *config.Config, address string) *Adapter {
+	pooled := clients.get(cfg, address)
 
-	c.client = client
-	return c
+	return &Adapter{
+		client:             pooled.client,
+		Config:             pooled.config,
+		Resolver:           c.Resolver,
+		NodeResolver:       c.NodeResolver,
+		namespaceMirroring: cfg.Controller.ConsulNamespaceMirroring,
+		serviceNamespaces:  make(map[string]string),
+		dryRun:             cfg.Controller.DryRun,
+		clusterName:        cfg.Controller.ClusterName,
+		retry:              newRetryPolicy(cfg),
+	}
 }
 
 // Register registers new service in Consul
 func (c *Adapter) Register(service *consulapi.AgentServiceRegistration) error {
+	if c.catalogNode != "" {
+		// Checks of services on synthetic nodes are run by consul-esm
+		nodeMeta := c.catalogNodeMeta()
+		nodeMeta["external-node"] = "true"
+		nodeMeta["external-probe"] = "false"
+		return c.catalogRegister(c.catalogNode, nodeMeta, service)
+	}
+	if c.record("register", "", service) {
+		return nil
+	}
 	glog.V(1).Infof("Registering service %s with ID: %s", service.Name, service.ID)
-	return c.client.Agent().ServiceRegister(service)
+	return c.call(func() error {
+		return c.client.Agent().ServiceRegister(service)
+	})
 }
 
 // Deregister deregisters a service in Consul
 func (c *Adapter) Deregister(service *consulapi.AgentServiceRegistration) error {
+	if c.catalogNode != "" {
+		return c.CatalogDeregister(c.catalogNode, service)
+	}
+	if c.record("deregister", "", service) {
+		return nil
+	}
 	glog.V(1).Infof("Deregistering service with ID: %s", service.ID)
-	return c.client.Agent().ServiceDeregister(service.ID)
+	return c.call(func() error {
+		return c.client.Agent().ServiceDeregisterOpts(service.ID, c.queryOptions(service))
+	})
+}
+
+// EnableMaintenance puts a service in maintenance mode, the service is marked as critical
+func (c *Adapter) EnableMaintenance(service *consulapi.AgentServiceRegistration, reason string) error {
+	if c.record("enable_maintenance", c.catalogNode, service) {
+		return nil
+	}
+	glog.V(1).Infof("Enabling maintenance of service with ID: %s", service.ID)
+	if c.catalogNode != "" {
+		// The same address and partition as in registration of node, the node itself isn't updated
+		registration := &consulapi.CatalogRegistration{
+			Node:           c.catalogNode,
+			Address:        c.catalogNodeAddress(c.catalogNode),
+			SkipNodeUpdate: true,
+			Partition:      c.Config.Partition,
+			Check: &consulapi.AgentCheck{
+				Node:      c.catalogNode,
+				CheckID:   maintenanceCheckID(service.ID),
+				Name:      "Service Maintenance Mode",
+				Status:    consulapi.HealthCritical,
+				Notes:     reason,
+				ServiceID: service.ID,
+				Namespace: c.queryOptions(service).Namespace,
+				Partition: c.Config.Partition,
+			},
+		}
+		return c.call(func() error {
+			_, err := c.client.Catalog().Register(registration, nil)
+			return err
+		})
+	}
+	return c.call(func() error {
+		return c.client.Agent().EnableServiceMaintenanceOpts(service.ID, reason, c.queryOptions(service))
+	})
+}
+
+// DisableMaintenance puts a service back from maintenance mode
+func (c *Adapter) DisableMaintenance(service *consulapi.AgentServiceRegistration) error {
+	if c.record("disable_maintenance", c.catalogNode, service) {
+		return nil
+	}
+	glog.V(1).Infof("Disabling maintenance of service with ID: %s", service.ID)
+	if c.catalogNode != "" {
+		deregistration := &consulapi.CatalogDeregistration{
+			Node:      c.catalogNode,
+			CheckID:   maintenanceCheckID(service.ID),
+			Namespace: c.queryOptions(service).Namespace,
+			Partition: c.Config.Partition,
+		}
+		return c.call(func() error {
+			_, err := c.client.Catalog().Deregister(deregistration, nil)
+			return err
+		})
+	}
+	return c.call(func() error {
+		return c.client.Agent().DisableServiceMaintenanceOpts(service.ID, c.queryOptions(service))
+	})
+}
+
+// CatalogRegister registers service in Consul catalog on the external node with given name,
+// the node is owned by the cluster if `cluster_name` option is set. The external node is not
+// a synthetic node of `catalog` mode, so it's never removed by cleaning of synthetic nodes.
+func (c *Adapter) CatalogRegister(node string, service *consulapi.AgentServiceRegistration) error {
+	nodeMeta := map[string]string{
+		"external-node":  "true",
+		"external-probe": "false",
+	}
+	if c.clusterName != "" {
+		nodeMeta[ClusterMetaKey] = c.clusterName
+	}
+	return c.catalogRegister(node, nodeMeta, service)
+}
+
+func (c *Adapter) catalogRegister(node string, nodeMeta map[string]string, service *consulapi.AgentServiceRegistration) error {
+	// Catalog doesn't create sidecar proxy of service, it has to be registered separately
+	// with given port, nothing is registered without it
+	if service.Connect != nil && service.Connect.SidecarService != nil && service.Connect.SidecarService.Port == 0 {
+		return fmt.Errorf("port of sidecar proxy of service %s is required in catalog", service.ID)
+	}
+	if c.record("register", node, service) {
+		return nil
+	}
+	glog.V(1).Infof("Registering service %s with ID: %s on node %s in catalog", service.Name, service.ID, node)
+	var connect *consulapi.AgentServiceConnect
+	if service.Connect != nil && service.Connect.Native {
+		connect = &consulapi.AgentServiceConnect{Native: true}
+	}
+	// Default weights of Consul
+	weights := consulapi.AgentWeights{Passing: 1, Warning: 1}
+	if service.Weights != nil {
+		weights = *service.Weights
+	}
+
+	registration := &consulapi.CatalogRegistration{
+		Node:      node,
+		Address:   c.catalogNodeAddress(node),
+		NodeMeta:  nodeMeta,
+		Partition: c.Config.Partition,
+		Service: &consulapi.AgentService{
+			ID:              service.ID,
+			Service:         service.Name,
+			Tags:            service.Tags,
+			Meta:            service.Meta,
+			Port:            service.Port,
+			Address:         service.Address,
+			TaggedAddresses: service.TaggedAddresses,
+			Namespace:       service.Namespace,
+			Partition:       c.Config.Partition,
+			Connect:         connect,
+			Weights:         weights,
+		},
+		Checks: checksToHealthChecks(node, service),
+	}
+	err := c.call(func() error {
+		_, err := c.client.Catalog().Register(registration, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if service.Connect == nil || service.Connect.SidecarService == nil {
+		return nil
+	}
+	sidecar := service.Connect.SidecarService
+	tags := sidecar.Tags
+	if len(tags) == 0 {
+		tags = service.Tags
+	}
+	proxy := &consulapi.AgentServiceConnectProxyConfig{
+		DestinationServiceName: service.Name,
+		DestinationServiceID:   service.ID,
+		LocalServiceAddress:    "127.0.0.1",
+		LocalServicePort:       service.Port,
+	}
+	if sidecar.Proxy != nil {
+		proxy.Upstreams = sidecar.Proxy.Upstreams
+	}
+	registration.Service = &consulapi.AgentService{
+		Kind:      consulapi.ServiceKindConnectProxy,
+		ID:        SidecarServiceID(service.ID),
+		Service:   fmt.Sprintf("%s-sidecar-proxy", service.Name),
+		Tags:      tags,
+		Meta:      service.Meta,
+		Port:      sidecar.Port,
+		Address:   sidecar.Address,
+		Namespace: service.Namespace,
+		Partition: c.Config.Partition,
+		Proxy:     proxy,
+	}
+	registration.Checks = nil
+	err = c.call(func() error {
+		_, err := c.client.Catalog().Register(registration, nil)
+		return err
+	})
+	return err
+}
+
+// CatalogDeregister deregisters service from the node with given name in Consul catalog
+func (c *Adapter) CatalogDeregister(node string, service *consulapi.AgentServiceRegistration) error {
+	if c.record("deregister", node, service) {
+		return nil
+	}
+	glog.V(1).Infof("Deregistering service with ID: %s from node %s in catalog", service.ID, node)
+	deregistration := &consulapi.CatalogDeregistration{
+		Node:      node,
+		ServiceID: service.ID,
+		Namespace: c.queryOptions(service).Namespace,
+		Partition: c.Config.Partition,
+	}
+	err := c.call(func() error {
+		_, err := c.client.Catalog().Deregister(deregistration, nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sidecar proxy is not removed together with service in catalog
+	if service.Connect != nil && service.Connect.SidecarService != nil {
+		deregistration.ServiceID = SidecarServiceID(service.ID)
+		err = c.call(func() error {
+			_, err := c.client.Catalog().Deregister(deregistration, nil)
+			return err
+		})
+	}
+	return err
+}
+
+// CatalogNodes returns names of synthetic nodes created in `catalog` mode,
+// only nodes of the cluster are returned if `cluster_name` option is set
+func (c *Adapter) CatalogNodes() ([]string, error) {
+	var nodes []*consulapi.Node
+	err := c.call(func() (err error) {
+		nodes, _, err = c.client.Catalog().Nodes(&consulapi.QueryOptions{
+			NodeMeta:  c.catalogNodeMeta(),
+			Partition: c.Config.Partition,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, node := range nodes {
+		names = append(names, node.Node)
+	}
+	return names, nil
+}
+
+// CatalogDeregisterNode deregisters synthetic node with given name from Consul catalog,
+// together with all services registered on it
+func (c *Adapter) CatalogDeregisterNode(node string) error {
+	if c.record("deregister_node", node, nil) {
+		return nil
+	}
+	glog.Infof("Deregistering node %s from catalog", node)
+	return c.call(func() error {
+		_, err := c.client.Catalog().Deregister(&consulapi.CatalogDeregistration{
+			Node:      node,
+			Partition: c.Config.Partition,
+		}, nil)
+		return err
+	})
+}
+
+// catalogNodeAddress returns IP address of Kubernetes node which the node in Consul catalog represents,
+// name of node is used for nodes which don't represent Kubernetes node, e.g. the external node
+func (c *Adapter) catalogNodeAddress(node string) string {
+	if c.NodeResolver != nil {
+		if address, ok := c.NodeResolver.NodeAddress(node); ok {
+			return address
+		}
+	}
+	return node
+}
+
+// catalogNodeMeta returns meta of synthetic nodes created in `catalog` mode,
+// nodes are owned by the cluster if `cluster_name` option is set
+func (c *Adapter) catalogNodeMeta() map[string]string {
+	nodeMeta := map[string]string{CatalogNodeMetaKey: "true"}
+	if c.clusterName != "" {
+		nodeMeta[ClusterMetaKey] = c.clusterName
+	}
+	return nodeMeta
+}
+
+// CatalogServices returns all services registered on the node with given name in Consul catalog
+func (c *Adapter) CatalogServices(node string) (map[string]*consulapi.AgentService, error) {
+	glog.V(1).Infof("Getting Consul services of node %s from catalog", node)
+	var catalogNode *consulapi.CatalogNode
+	err := c.call(func() (err error) {
+		catalogNode, _, err = c.client.Catalog().Node(node, c.listOptions())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if catalogNode == nil {
+		return make(map[string]*consulapi.AgentService), nil
+	}
+	c.saveNamespaces(catalogNode.Services)
+	return catalogNode.Services, nil
 }
 
 // Services returns all services from a Consul Agent
 func (c *Adapter) Services() (map[string]*consulapi.AgentService, error) {
+	if c.catalogNode != "" {
+		return c.CatalogServices(c.catalogNode)
+	}
 	glog.V(1).Info("Getting Consul services")
-	return c.client.Agent().Services()
+	var services map[string]*consulapi.AgentService
+	err := c.call(func() (err error) {
+		services, err = c.client.Agent().ServicesWithFilterOpts("", c.listOptions())
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.saveNamespaces(services)
+	return services, nil
+}
+
+// ServiceChecks returns checks of services grouped by ID of service, maintenance checks are omitted
+func (c *Adapter) ServiceChecks() (map[string][]*consulapi.AgentCheck, error) {
+	return c.serviceChecks(c.catalogNode, c.listOptions())
+}
+
+// serviceChecks returns checks of services grouped by ID of service, checks are taken from the node
+// with given name in Consul catalog or from Consul Agent if node is empty. Checks of maintenance mode are omitted.
+func (c *Adapter) serviceChecks(node string, options *consulapi.QueryOptions) (map[string][]*consulapi.AgentCheck, error) {
+	var checks = make(map[string][]*consulapi.AgentCheck)
+
+	if node != "" {
+		glog.V(1).Infof("Getting Consul checks of node %s from catalog", node)
+		var healthChecks consulapi.HealthChecks
+		err := c.call(func() (err error) {
+			healthChecks, _, err = c.client.Health().Node(node, options)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, check := range healthChecks {
+			if check.ServiceID == "" || strings.HasPrefix(check.CheckID, maintenanceCheckID("")) {
+				continue
+			}
+			checks[check.ServiceID] = append(checks[check.ServiceID], &consulapi.AgentCheck{
+				Node:       check.Node,
+				CheckID:    check.CheckID,
+				Name:       check.Name,
+				Status:     check.Status,
+				ServiceID:  check.ServiceID,
+				Definition: check.Definition,
+				Namespace:  check.Namespace,
+			})
+		}
+		return checks, nil
+	}
+
+	glog.V(1).Info("Getting Consul checks")
+	var agentChecks map[string]*consulapi.AgentCheck
+	err := c.call(func() (err error) {
+		agentChecks, err = c.client.Agent().ChecksWithFilterOpts(options.Filter, options)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, check := range agentChecks {
+		if check.ServiceID == "" || strings.HasPrefix(check.CheckID, maintenanceCheckID("")) {
+			continue
+		}
+		checks[check.ServiceID] = append(checks[check.ServiceID], check)
+	}
+	return checks, nil
+}
+
+// listOptions returns options of request which lists services,
+// in mirroring mode services are listed from all namespaces
+func (c *Adapter) listOptions() *consulapi.QueryOptions {
+	if c.namespaceMirroring {
+		return &consulapi.QueryOptions{Namespace: "*"}
+	}
+	return &consulapi.QueryOptions{}
+}
+
+// queryOptions returns options of request for given service, namespace is taken from
+// registration of service or from the last listing of services
+func (c *Adapter) queryOptions(service *consulapi.AgentServiceRegistration) *consulapi.QueryOptions {
+	namespace := service.Namespace
+	if namespace == "" {
+		namespace = c.serviceNamespaces[service.ID]
+	}
+	return &consulapi.QueryOptions{Namespace: namespace}
+}
+
+func (c *Adapter) saveNamespaces(services map[string]*consulapi.AgentService) {
+	for _, service := range services {
+		if service.Namespace != "" {
+			c.serviceNamespaces[service.ID] = service.Namespace
+		}
+	}
+}
+
+// IsServiceChanged checks if desired registration of service differs from the registered one.
+// Order of tags is not taken into account.
+func IsServiceChanged(registered, desired *consulapi.AgentServiceRegistration) bool {
+	if registered == nil || desired == nil {
+		return registered != desired
+	}
+
+	a, b := *registered, *desired
+	a.Tags, b.Tags = sortedTags(a.Tags), sortedTags(b.Tags)
+	if len(a.Meta) == 0 && len(b.Meta) == 0 {
+		a.Meta, b.Meta = nil, nil
+	}
+	return !reflect.DeepEqual(a, b)
+}
+
+// ServiceDrift returns names of fields which differ between desired registration of service
+// and the service registered in Consul together with its checks.
+// Checks are compared by their HTTP and TCP targets, the same target can be used by more than one check.
+func ServiceDrift(desired *consulapi.AgentServiceRegistration, registered *consulapi.AgentService, checks []*consulapi.AgentCheck) []string {
+	var fields []string
+
+	if desired.Name != registered.Service {
+		fields = append(fields, "name")
+	}
+	if desired.Address != registered.Address {
+		fields = append(fields, "address")
+	}
+	if desired.Port != registered.Port {
+		fields = append(fields, "port")
+	}
+	if !reflect.DeepEqual(sortedTags(desired.Tags), sortedTags(registered.Tags)) {
+		fields = append(fields, "tags")
+	}
+	if (len(desired.Meta) != 0 || len(registered.Meta) != 0) && !reflect.DeepEqual(desired.Meta, registered.Meta) {
+		fields = append(fields, "meta")
+	}
+
+	// Default weights of Consul
+	weights := consulapi.AgentWeights{Passing: 1, Warning: 1}
+	if desired.Weights != nil {
+		weights = *desired.Weights
+	}
+	if weights != registered.Weights {
+		fields = append(fields, "weights")
+	}
+
+	// Desired checks are counted by target, e.g. liveness and readiness probes often have the same target
+	var desiredChecks = make(map[string]int)
+	var desiredCount int
+	for _, check := range desired.Checks {
+		if check == nil || (check.HTTP == "" && check.TCP == "") {
+			continue
+		}
+		desiredChecks[check.HTTP+check.TCP]++
+		desiredCount++
+	}
+	changed := desiredCount != len(checks)
+	for _, check := range checks {
+		target := check.Definition.HTTP + check.Definition.TCP
+		// Definition of check is not reported by old versions of Consul
+		if target == "" {
+			continue
+		}
+		if desiredChecks[target] == 0 {
+			changed = true
+			continue
+		}
+		desiredChecks[target]--
+	}
+	if changed {
+		fields = append(fields, "checks")
+	}
+
+	return fields
+}
+
+func sortedTags(tags []string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	sorted := append([]string{}, tags...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// checksToHealthChecks converts checks of service into checks registered in catalog.
+// Catalog checks are not run by Consul Agent but by consul-esm according to their definition,
+// the initial status of check is taken from the service definition.
+func checksToHealthChecks(node string, service *consulapi.AgentServiceRegistration) consulapi.HealthChecks {
+	var checks consulapi.HealthChecks
+
+	for i, check := range service.Checks {
+		if check == nil || (check.HTTP == "" && check.TCP == "") {
+			continue
+		}
+
+		status := check.Status
+		if status == "" {
+			status = consulapi.HealthPassing
+		}
+
+		checks = append(checks, &consulapi.HealthCheck{
+			Node:      node,
+			CheckID:   fmt.Sprintf("service:%s:%d", service.ID, i+1),
+			Name:      check.Name,
+			Status:    status,
+			ServiceID: service.ID,
+			Namespace: service.Namespace,
+			Definition: consulapi.HealthCheckDefinition{
+				HTTP:             check.HTTP,
+				TCP:              check.TCP,
+				TLSSkipVerify:    check.TLSSkipVerify,
+				IntervalDuration: parseDuration(check.Interval),
+				TimeoutDuration:  parseDuration(check.Timeout),
+			},
+		})
+	}
+	return checks
+}
+
+// parseDuration returns duration of check, zero is returned for invalid duration
+func parseDuration(value string) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0
+	}
+	return duration
+}
+
+func maintenanceCheckID(serviceID string) string {
+	return fmt.Sprintf("_service_maintenance:%s", serviceID)
 }
@@ -1,6 +1,12 @@
 package consul
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,6 +15,7 @@ import (
 	consulapi "github.com/hashicorp/consul/api"
 
 	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/utils"
 )
 
 func TestNew(t *testing.T) {
@@ -26,45 +33,316 @@ func TestNew(t *testing.T) {
 	}
 
 	consulInstance := Adapter{}
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent := consulInstance.New(cfg, "pod_name", "127.0.0.1")
 
-	assert.Equal(t, cfg.Consul.Address, "localhost:8500", "wrong URI")
-	assert.Equal(t, cfg.Consul.Scheme, "http", "wrong scheme")
-	assert.Equal(t, cfg.Consul.Token, "token", "wrong token")
-	assert.Equal(t, cfg.Consul.HttpClient.Timeout, time.Duration(0), "wrong timeout")
+	assert.Equal(t, consulAgent.Config.Address, "localhost:8500", "wrong URI")
+	assert.Equal(t, consulAgent.Config.Scheme, "http", "wrong scheme")
+	assert.Equal(t, consulAgent.Config.Token, "token", "wrong token")
+	assert.Equal(t, consulAgent.Config.HttpClient.Timeout, time.Duration(0), "wrong timeout")
+	assert.Equal(t, "127.0.0.1:8500", cfg.Consul.Address, "configuration shouldn't be changed")
 
 	// Tests Consul Timeout
 	cfg.Controller.ConsulTimeout = time.Duration(1 * time.Second)
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
 
-	assert.Equal(t, cfg.Consul.HttpClient.Timeout, time.Duration(1*time.Second), "wrong timeout")
+	assert.Equal(t, consulAgent.Config.HttpClient.Timeout, time.Duration(1*time.Second), "wrong timeout")
 
 	// Tests RegisterNodeMode
 	cfg.Controller.RegisterMode = config.RegisterNodeMode
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
 
-	assert.Equal(t, "pod_name:8500", cfg.Consul.Address, "wrong URI")
+	assert.Equal(t, "pod_name:8500", consulAgent.Config.Address, "wrong URI")
 
 	// Tests RegisterPodMode
 	cfg.Controller.RegisterMode = config.RegisterPodMode
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
 
-	assert.Equal(t, "127.0.0.1:8500", cfg.Consul.Address, "wrong URI")
+	assert.Equal(t, "127.0.0.1:8500", consulAgent.Config.Address, "wrong URI")
 
 	// Tests https scheme
 	cfg.Controller.ConsulScheme = "https"
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
 
-	assert.Equal(t, "https", cfg.Consul.Scheme, "wrong scheme")
+	assert.Equal(t, "https", consulAgent.Config.Scheme, "wrong scheme")
 
 	// Tests consul-unix scheme
 	cfg.Controller.ConsulScheme = "consul-unix"
 	cfg.Controller.RegisterMode = config.RegisterSingleMode
 	cfg.Controller.ConsulPort = "8500"
-	consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
+
+	assert.Equal(t, "localhost:8500", consulAgent.Config.Address, "wrong URI")
+
+	// Tests explicit Consul Agent
+	cfg.Controller.ConsulScheme = "http"
+	cfg.Controller.RegisterMode = config.RegisterNodeMode
+	consulAgent = consulInstance.NewForAgent(cfg, "agent")
+
+	assert.Equal(t, "agent:8500", consulAgent.Config.Address, "wrong URI")
+	assert.Equal(t, "", consulAgent.catalogNode, "wrong catalog node")
+
+	// Tests RegisterCatalogMode
+	cfg.Controller.RegisterMode = config.RegisterCatalogMode
+	cfg.Controller.CatalogNodeMode = config.CatalogNodePerNode
+	cfg.Controller.CatalogNodeName = "kubernetes"
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
+
+	assert.Equal(t, "localhost:8500", consulAgent.Config.Address, "wrong URI")
+	assert.Equal(t, "pod_name", consulAgent.catalogNode, "wrong catalog node")
+
+	consulAgent = consulInstance.New(cfg, "", "")
+	assert.Equal(t, "kubernetes", consulAgent.catalogNode, "wrong catalog node")
+
+	cfg.Controller.CatalogNodeMode = config.CatalogNodePerCluster
+	consulAgent = consulInstance.New(cfg, "pod_name", "127.0.0.1")
+	assert.Equal(t, "kubernetes", consulAgent.catalogNode, "wrong catalog node")
+}
+
+type testResolver map[string]string
+
+func (r testResolver) AgentAddress(nodeName string) (string, bool) {
+	address, ok := r[nodeName]
+	return address, ok
+}
+
+func (r testResolver) NodeAddress(nodeName string) (string, bool) {
+	return r.AgentAddress(nodeName)
+}
+
+// lookupResolver is testResolver which records names of looked up nodes
+type lookupResolver struct {
+	testResolver
+	lookups []string
+}
+
+func (r *lookupResolver) AgentAddress(nodeName string) (string, bool) {
+	r.lookups = append(r.lookups, nodeName)
+	return r.testResolver.AgentAddress(nodeName)
+}
+
+func TestAgentAddressPrecedence(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulPort:   "8500",
+			ConsulScheme: "http",
+			RegisterMode: config.RegisterNodeMode,
+			// Node "removed" doesn't exist in Kubernetes anymore, so it's unknown to resolver
+			ConsulAgentAddresses: map[string]string{
+				"node-1":  "agent-1:8501",
+				"removed": "https://10.0.0.9:8501",
+				"":        "ignored",
+			},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		nodeName    string
+		defaultHost string
+		expected    string
+		lookups     []string
+	}{
+		{
+			name:        "override over resolver and default host",
+			nodeName:    "node-1",
+			defaultHost: "192.168.0.1",
+			expected:    "http://agent-1:8501",
+		},
+		{
+			name:        "resolver over default host",
+			nodeName:    "node-2",
+			defaultHost: "192.168.0.2",
+			expected:    "http://10.0.0.2:8500",
+			lookups:     []string{"node-2"},
+		},
+		{
+			name:        "default host of unknown node",
+			nodeName:    "node-3",
+			defaultHost: "192.168.0.3",
+			expected:    "http://192.168.0.3:8500",
+			lookups:     []string{"node-3"},
+		},
+		{
+			name:        "override of node which no longer exists",
+			nodeName:    "removed",
+			defaultHost: "removed",
+			expected:    "https://10.0.0.9:8501",
+		},
+		{
+			name:        "default host without node",
+			defaultHost: "127.0.0.1",
+			expected:    "http://127.0.0.1:8500",
+		},
+	}
 
-	assert.Equal(t, "localhost:8500", cfg.Consul.Address, "wrong URI")
+	for _, test := range tests {
+		resolver := &lookupResolver{testResolver: testResolver{"node-1": "10.0.0.1", "node-2": "10.0.0.2"}}
+		adapter := &Adapter{Resolver: resolver}
+		assert.Equal(t, test.expected, adapter.agentAddress(cfg, test.nodeName, test.defaultHost), test.name)
+		assert.Equal(t, test.lookups, resolver.lookups, test.name)
+	}
 
+	// Override of removed node doesn't change agents of other nodes
+	adapter := &Adapter{Resolver: testResolver{"node-2": "10.0.0.2"}}
+	assert.Equal(t, "http://10.0.0.2:8500", adapter.agentAddress(cfg, "node-2", "192.168.0.2"))
+	assert.Equal(t, "http://192.168.0.1:8500", adapter.agentAddress(&config.Config{Controller: &config.ControllerConfig{
+		ConsulPort:   "8500",
+		ConsulScheme: "http",
+	}}, "node-1", "192.168.0.1"), "agent of node without override should be found by default host")
+}
+
+func TestAgentResolver(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulPort:   "8500",
+			ConsulScheme: "http",
+			RegisterMode: config.RegisterNodeMode,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+
+	consulInstance := Adapter{Resolver: testResolver{"node": "10.0.0.1"}}
+	consulAgent := consulInstance.New(cfg, "node", "127.0.0.1")
+	assert.Equal(t, "10.0.0.1:8500", consulAgent.Config.Address, "wrong URI")
+	assert.NotNil(t, consulAgent.Resolver, "resolver should be kept")
+
+	cfg.Controller.RegisterMode = config.RegisterPodMode
+	consulAgent = consulInstance.New(cfg, "node", "127.0.0.1")
+	assert.Equal(t, "10.0.0.1:8500", consulAgent.Config.Address, "wrong URI")
+
+	consulAgent = consulInstance.New(cfg, "", "127.0.0.1")
+	assert.Equal(t, "127.0.0.1:8500", consulAgent.Config.Address, "wrong URI")
+
+	consulAgent = consulInstance.New(cfg, "other", "127.0.0.1")
+	assert.Equal(t, "127.0.0.1:8500", consulAgent.Config.Address, "wrong URI")
+
+	// Tests override of address of Consul Agent
+	cfg.Controller.RegisterMode = config.RegisterNodeMode
+	cfg.Controller.ConsulAgentAddresses = map[string]string{"node": "agent:8501", "other": "https://10.0.0.2:8501"}
+	consulAgent = consulInstance.New(cfg, "node", "")
+	assert.Equal(t, "agent:8501", consulAgent.Config.Address, "wrong URI")
+	consulAgent = consulInstance.New(cfg, "other", "")
+	assert.Equal(t, "10.0.0.2:8501", consulAgent.Config.Address, "wrong URI")
+	assert.Equal(t, "https", consulAgent.Config.Scheme, "wrong scheme")
+
+	// Tests agent of node which is looked up by name of node, with address of node as fallback
+	consulAgent = consulInstance.NewForNode(cfg, "node", "192.168.0.1")
+	assert.Equal(t, "agent:8501", consulAgent.Config.Address, "wrong URI")
+	consulAgent = consulInstance.NewForNode(cfg, "unknown", "192.168.0.1")
+	assert.Equal(t, "192.168.0.1:8500", consulAgent.Config.Address, "wrong URI")
+}
+
+func TestClientPool(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulToken:             "token",
+			ConsulClientIdleTimeout: time.Minute,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+	pool := &clientPool{clients: make(map[string]*pooledClient)}
+
+	pooled := pool.get(cfg, "http://agent:8500")
+	assert.Equal(t, pooled, pool.get(cfg, "http://agent:8500"), "client should be cached")
+	assert.NotEqual(t, pooled, pool.get(cfg, "http://other:8500"), "client should be built for other address")
+
+	cfg.Controller.ConsulToken = "new-token"
+	rebuilt := pool.get(cfg, "http://agent:8500")
+	assert.NotEqual(t, pooled, rebuilt, "client should be built again after change of configuration")
+	assert.Equal(t, "new-token", rebuilt.config.Token, "wrong token")
+	assert.Equal(t, "token", pooled.config.Token, "configuration of client shouldn't be changed")
+
+	pool.clients["http://other:8500"].lastUsed = time.Now().Add(-2 * time.Minute)
+	pool.get(cfg, "http://agent:8500")
+	assert.NotContains(t, pool.clients, "http://other:8500", "idle client should be evicted")
+}
+
+func TestClientPoolToken(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulToken: "token",
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+	pool := &clientPool{clients: make(map[string]*pooledClient)}
+
+	pooled := pool.get(cfg, "http://agent:8500")
+	assert.Equal(t, "token", pooled.config.Token, "wrong token")
+
+	pool.token = "rotated-token"
+	rotated := pool.get(cfg, "http://agent:8500")
+	assert.NotEqual(t, pooled, rotated, "client should be built again after rotation of token")
+	assert.Equal(t, "rotated-token", rotated.config.Token, "rotated token should take precedence over consul_token option")
+	assert.Equal(t, rotated, pool.get(cfg, "http://agent:8500"), "client should be cached")
+}
+
+func TestNamespace(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress: "localhost",
+			ConsulPort:    "8500",
+			ConsulScheme:  "http",
+			RegisterMode:  config.RegisterSingleMode,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+
+	assert.Equal(t, "", Namespace(cfg, "default"), "wrong namespace")
+
+	cfg.Controller.ConsulNamespace = "team"
+	cfg.Controller.ConsulPartition = "part"
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+	assert.Equal(t, "team", Namespace(cfg, "default"), "wrong namespace")
+	assert.Equal(t, "team", consulAgent.Config.Namespace, "wrong namespace of client")
+	assert.Equal(t, "part", consulAgent.Config.Partition, "wrong partition of client")
+
+	cfg.Controller.ConsulNamespaceMirroring = true
+	cfg.Controller.ConsulNamespacePrefix = "k8s-"
+	consulAgent = consulInstance.New(cfg, "", "")
+	assert.Equal(t, "k8s-default", Namespace(cfg, "default"), "wrong namespace")
+	assert.Equal(t, "", consulAgent.Config.Namespace, "wrong namespace of client")
+}
+
+func TestOwnership(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag: "kubernetes",
+		},
+	}
+
+	service := &consulapi.AgentServiceRegistration{Tags: []string{"kubernetes"}}
+	SetOwner(cfg, service)
+	assert.Nil(t, service.Meta, "meta shouldn't be set without cluster name")
+	assert.True(t, IsOwned(cfg, service.Tags, service.Meta), "service should be owned")
+	assert.False(t, IsOwned(cfg, []string{"other"}, nil), "service without k8s tag shouldn't be owned")
+
+	cfg.Controller.ClusterName = "prod"
+	assert.False(t, IsOwned(cfg, service.Tags, service.Meta), "service without cluster name shouldn't be owned")
+
+	SetOwner(cfg, service)
+	assert.Equal(t, "prod", service.Meta[ClusterMetaKey], "wrong owner")
+	assert.Equal(t, []string{"kubernetes"}, service.Tags, "cluster tag shouldn't be added")
+	assert.True(t, IsOwned(cfg, service.Tags, service.Meta), "service should be owned")
+
+	cfg.Controller.ClusterNameTag = true
+	SetOwner(cfg, service)
+	assert.Contains(t, service.Tags, "cluster:prod", "cluster tag should be added")
+
+	cfg.Controller.ClusterName = "staging"
+	assert.False(t, IsOwned(cfg, service.Tags, service.Meta), "service of other cluster shouldn't be owned")
 }
 
 func TestConsulAdapterMethods(t *testing.T) {
@@ -93,4 +371,538 @@ func TestConsulAdapterMethods(t *testing.T) {
 	_, err = consulAgent.Services()
 	assert.NotNil(t, err, "An error was expected")
 
+	err = consulAgent.EnableMaintenance(&consulapi.AgentServiceRegistration{}, "reason")
+	assert.NotNil(t, err, "An error was expected")
+
+	err = consulAgent.DisableMaintenance(&consulapi.AgentServiceRegistration{})
+	assert.NotNil(t, err, "An error was expected")
+
+	err = consulAgent.CatalogRegister("node", &consulapi.AgentServiceRegistration{})
+	assert.NotNil(t, err, "An error was expected")
+
+	err = consulAgent.CatalogDeregister("node", &consulapi.AgentServiceRegistration{})
+	assert.NotNil(t, err, "An error was expected")
+
+	_, err = consulAgent.CatalogServices("node")
+	assert.NotNil(t, err, "An error was expected")
+
+}
+
+// newTestAgent starts fake Consul Agent which answers requests with given handler
+// and returns configuration of `single` mode which uses the agent
+func newTestAgent(t *testing.T, handler http.HandlerFunc) *config.Config {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	address, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	return &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress: address.Hostname(),
+			ConsulPort:    address.Port(),
+			ConsulScheme:  "http",
+			RegisterMode:  config.RegisterSingleMode,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+}
+
+func TestCatalogRegisterExternalNode(t *testing.T) {
+	t.Parallel()
+
+	var registration consulapi.CatalogRegistration
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/catalog/register" {
+			json.NewDecoder(r.Body).Decode(&registration)
+		}
+	})
+	cfg.Controller.ClusterName = "prod"
+
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+	assert.NoError(t, consulAgent.CatalogRegister("kubernetes-external-prod", &consulapi.AgentServiceRegistration{ID: "id", Name: "name"}))
+	assert.Equal(t, "kubernetes-external-prod", registration.Node)
+	assert.Equal(t, "true", registration.NodeMeta["external-node"])
+	assert.Equal(t, "prod", registration.NodeMeta[ClusterMetaKey], "external node should be owned by the cluster")
+	assert.NotContains(t, registration.NodeMeta, CatalogNodeMetaKey, "external node shouldn't be cleaned as synthetic node")
+}
+
+func TestCatalogMaintenance(t *testing.T) {
+	t.Parallel()
+
+	var registrations []consulapi.CatalogRegistration
+	var partitions []string
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/catalog/register" {
+			var registration consulapi.CatalogRegistration
+			json.NewDecoder(r.Body).Decode(&registration)
+			registrations = append(registrations, registration)
+			partitions = append(partitions, r.URL.Query().Get("partition"))
+		}
+	})
+	cfg.Controller.RegisterMode = config.RegisterCatalogMode
+	cfg.Controller.CatalogNodeMode = config.CatalogNodePerNode
+	cfg.Controller.ConsulPartition = "team"
+
+	consulInstance := Adapter{NodeResolver: testResolver{"node-1": "192.168.0.1"}}
+	consulAgent := consulInstance.New(cfg, "node-1", "")
+	service := &consulapi.AgentServiceRegistration{ID: "id", Name: "name", Namespace: "default"}
+	assert.NoError(t, consulAgent.Register(service))
+	assert.NoError(t, consulAgent.EnableMaintenance(service, "Node is not ready"))
+
+	assert.Len(t, registrations, 2)
+	registration, maintenance := registrations[0], registrations[1]
+	assert.Equal(t, "192.168.0.1", registration.Address)
+	assert.Equal(t, registration.Address, maintenance.Address, "maintenance should keep address of node")
+	assert.Equal(t, "node-1", maintenance.Node)
+	assert.True(t, maintenance.SkipNodeUpdate)
+	assert.Equal(t, "team", maintenance.Partition)
+	assert.Equal(t, "team", maintenance.Check.Partition)
+	assert.Equal(t, "default", maintenance.Check.Namespace)
+	assert.Equal(t, maintenanceCheckID("id"), maintenance.Check.CheckID)
+	assert.Equal(t, consulapi.HealthCritical, maintenance.Check.Status)
+	assert.Equal(t, []string{"team", "team"}, partitions)
+}
+
+func TestCatalogRegisterSidecarPort(t *testing.T) {
+	t.Parallel()
+
+	var registered int
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/catalog/register" {
+			registered++
+		}
+	})
+	cfg.Controller.RegisterMode = config.RegisterCatalogMode
+	cfg.Controller.CatalogNodeMode = config.CatalogNodePerNode
+
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "node-1", "")
+	service := &consulapi.AgentServiceRegistration{
+		ID:      "id",
+		Name:    "name",
+		Connect: &consulapi.AgentServiceConnect{SidecarService: &consulapi.AgentServiceRegistration{}},
+	}
+	assert.Error(t, consulAgent.Register(service), "port of sidecar proxy should be required")
+	assert.Equal(t, 0, registered, "service shouldn't be registered without its sidecar proxy")
+}
+
+func TestIsServiceChanged(t *testing.T) {
+	t.Parallel()
+
+	registered := &consulapi.AgentServiceRegistration{
+		ID:   "id",
+		Name: "name",
+		Tags: []string{"a", "b"},
+		Port: 80,
+	}
+	desired := &consulapi.AgentServiceRegistration{
+		ID:   "id",
+		Name: "name",
+		Tags: []string{"b", "a"},
+		Meta: map[string]string{},
+		Port: 80,
+	}
+
+	assert.False(t, IsServiceChanged(registered, desired), "order of tags should be ignored")
+	assert.True(t, IsServiceChanged(nil, desired), "service should be changed")
+
+	desired.Meta["key"] = "value"
+	assert.True(t, IsServiceChanged(registered, desired), "service should be changed")
+
+	desired.Meta = nil
+	desired.Weights = &consulapi.AgentWeights{Passing: 10, Warning: 1}
+	assert.True(t, IsServiceChanged(registered, desired), "service should be changed")
+	assert.Equal(t, []string{"b", "a"}, desired.Tags, "tags should not be modified")
+}
+
+func TestServiceDrift(t *testing.T) {
+	t.Parallel()
+
+	desired := &consulapi.AgentServiceRegistration{
+		ID:      "id",
+		Name:    "name",
+		Tags:    []string{"a", "b"},
+		Port:    80,
+		Address: "10.0.0.1",
+		Checks: consulapi.AgentServiceChecks{
+			{TCP: "10.0.0.1:80"},
+		},
+	}
+	registered := &consulapi.AgentService{
+		ID:      "id",
+		Service: "name",
+		Tags:    []string{"b", "a"},
+		Meta:    map[string]string{},
+		Port:    80,
+		Address: "10.0.0.1",
+		Weights: consulapi.AgentWeights{Passing: 1, Warning: 1},
+	}
+	checks := []*consulapi.AgentCheck{
+		{CheckID: "service:id", ServiceID: "id", Definition: consulapi.HealthCheckDefinition{TCP: "10.0.0.1:80"}},
+	}
+
+	assert.Empty(t, ServiceDrift(desired, registered, checks), "there should be no drift")
+
+	registered.Address = "10.0.0.2"
+	registered.Port = 8080
+	registered.Meta["key"] = "value"
+	registered.Weights.Passing = 10
+	checks[0].Definition.TCP = "10.0.0.2:8080"
+	assert.Equal(t, []string{"address", "port", "meta", "weights", "checks"}, ServiceDrift(desired, registered, checks))
+
+	assert.Equal(t, []string{"address", "port", "meta", "weights", "checks"}, ServiceDrift(desired, registered, nil))
+}
+
+func TestServiceDriftSameCheckTargets(t *testing.T) {
+	t.Parallel()
+
+	// Liveness and readiness probes of pod with the same target
+	desired := &consulapi.AgentServiceRegistration{
+		ID:      "id",
+		Name:    "name",
+		Port:    80,
+		Address: "10.0.0.1",
+		Checks: consulapi.AgentServiceChecks{
+			{HTTP: "http://10.0.0.1:80/health"},
+			{HTTP: "http://10.0.0.1:80/health"},
+		},
+	}
+	registered := &consulapi.AgentService{
+		ID:      "id",
+		Service: "name",
+		Port:    80,
+		Address: "10.0.0.1",
+		Weights: consulapi.AgentWeights{Passing: 1, Warning: 1},
+	}
+	checks := []*consulapi.AgentCheck{
+		{CheckID: "service:id:1", ServiceID: "id", Definition: consulapi.HealthCheckDefinition{HTTP: "http://10.0.0.1:80/health"}},
+		{CheckID: "service:id:2", ServiceID: "id", Definition: consulapi.HealthCheckDefinition{HTTP: "http://10.0.0.1:80/health"}},
+	}
+
+	assert.Empty(t, ServiceDrift(desired, registered, checks), "there should be no drift")
+	assert.Equal(t, []string{"checks"}, ServiceDrift(desired, registered, checks[:1]), "missing check should be a drift")
+
+	checks[1].Definition.HTTP = "http://10.0.0.1:80/ready"
+	assert.Equal(t, []string{"checks"}, ServiceDrift(desired, registered, checks), "changed check should be a drift")
+}
+
+func TestCatalogChecks(t *testing.T) {
+	t.Parallel()
+
+	service := &consulapi.AgentServiceRegistration{
+		ID: "id",
+		Checks: consulapi.AgentServiceChecks{
+			{HTTP: "http://10.0.0.1:80/health", Interval: "10s", Timeout: "2s", Status: "passing"},
+			{TCP: "10.0.0.1:80", Interval: "invalid"},
+		},
+	}
+
+	checks := checksToHealthChecks("node", service)
+	assert.Len(t, checks, 2)
+	assert.Equal(t, 10*time.Second, checks[0].Definition.IntervalDuration, "interval is required by consul-esm")
+	assert.Equal(t, 2*time.Second, checks[0].Definition.TimeoutDuration)
+	assert.Equal(t, "passing", checks[0].Status)
+	assert.Equal(t, time.Duration(0), checks[1].Definition.IntervalDuration)
+	assert.Equal(t, consulapi.HealthPassing, checks[1].Status)
+
+	adapter := &Adapter{NodeResolver: testResolver{"node": "10.0.0.1"}}
+	assert.Equal(t, "10.0.0.1", adapter.catalogNodeAddress("node"), "address of Kubernetes node should be used")
+	assert.Equal(t, "kubernetes", adapter.catalogNodeAddress("kubernetes"), "name of node should be used")
+}
+
+func TestDryRunChange(t *testing.T) {
+	t.Parallel()
+
+	registered := &consulapi.AgentService{ID: "id", Service: "name", Port: 80, Weights: consulapi.AgentWeights{Passing: 1, Warning: 1}}
+	check := &consulapi.AgentCheck{CheckID: "check", ServiceID: "id", Definition: consulapi.HealthCheckDefinition{HTTP: "http://10.0.0.1/health"}}
+	var requests []string
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, fmt.Sprintf("%s?filter=%s", r.URL.Path, r.URL.Query().Get("filter")))
+		var body interface{}
+		switch r.URL.Path {
+		case "/v1/agent/services":
+			services := map[string]*consulapi.AgentService{}
+			if r.URL.Query().Get("filter") == `ID == "id"` {
+				services["id"] = registered
+			}
+			body = services
+		case "/v1/agent/checks":
+			body = map[string]*consulapi.AgentCheck{"check": check}
+		case "/v1/catalog/node/external":
+			body = &consulapi.CatalogNode{
+				Node:     &consulapi.Node{Node: "external"},
+				Services: map[string]*consulapi.AgentService{"id": registered},
+			}
+		case "/v1/health/node/external":
+			body = consulapi.HealthChecks{{CheckID: "check", ServiceID: "id", Definition: check.Definition}}
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+	newService := func(id string, port int) *consulapi.AgentServiceRegistration {
+		return &consulapi.AgentServiceRegistration{
+			ID:     id,
+			Name:   "name",
+			Port:   port,
+			Checks: consulapi.AgentServiceChecks{{HTTP: "http://10.0.0.1/health"}},
+		}
+	}
+
+	assert.Equal(t, ChangeNone, consulAgent.change("", newService("id", 80)))
+	assert.Equal(t, ChangeUpdate, consulAgent.change("", newService("id", 8080)))
+	assert.Equal(t, ChangeAdd, consulAgent.change("", newService("other", 80)))
+	assert.Equal(t, []string{
+		`/v1/agent/services?filter=ID == "id"`,
+		`/v1/agent/checks?filter=ServiceID == "id"`,
+		`/v1/agent/services?filter=ID == "id"`,
+		`/v1/agent/checks?filter=ServiceID == "id"`,
+		`/v1/agent/services?filter=ID == "other"`,
+	}, requests, "only the service and its checks should be queried")
+
+	// Checks are taken from the given node, not from the agent
+	requests = nil
+	assert.Equal(t, ChangeNone, consulAgent.change("external", newService("id", 80)))
+	assert.Equal(t, []string{
+		`/v1/catalog/node/external?filter=ID == "id"`,
+		`/v1/health/node/external?filter=ServiceID == "id"`,
+	}, requests)
+}
+
+func TestDryRun(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress: "localhost",
+			ConsulPort:    "1",
+			ConsulScheme:  "http",
+			RegisterMode:  config.RegisterSingleMode,
+			DryRun:        true,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+	service := &consulapi.AgentServiceRegistration{ID: "dry-run-id", Name: "name"}
+
+	assert.NoError(t, consulAgent.Register(service))
+	assert.NoError(t, consulAgent.Register(service))
+	assert.NoError(t, consulAgent.Deregister(service))
+
+	var operations []string
+	for _, operation := range DryRunPlan.Operations() {
+		if operation.ServiceID == "dry-run-id" {
+			operations = append(operations, operation.Operation)
+		}
+	}
+	assert.Equal(t, []string{"register", "deregister"}, operations)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy := retryPolicy{backoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+
+	delay := policy.delay(0)
+	assert.True(t, delay >= 50*time.Millisecond && delay <= 100*time.Millisecond, "wrong delay of first retry")
+	delay = policy.delay(5)
+	assert.True(t, delay >= 150*time.Millisecond && delay <= 300*time.Millisecond, "delay should be limited by max backoff")
+
+	assert.True(t, isRetryable(fmt.Errorf("connection refused")), "network error should be retried")
+	assert.True(t, isRetryable(consulapi.StatusError{Code: 500}), "server error should be retried")
+	assert.False(t, isRetryable(consulapi.StatusError{Code: 403}), "rejected request shouldn't be retried")
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	t.Parallel()
+
+	policy := retryPolicy{breakerFailures: 2, breakerTimeout: time.Minute}
+	registry := &breakerRegistry{breakers: make(map[string]*breaker)}
+
+	assert.True(t, registry.allow("agent", policy), "request should be allowed")
+	assert.False(t, registry.done("agent", policy, true), "breaker shouldn't be open after one failure")
+	assert.True(t, registry.allow("agent", policy), "request should be allowed after one failure")
+	assert.True(t, registry.done("agent", policy, true), "breaker should be opened")
+	assert.False(t, registry.allow("agent", policy), "breaker should be open")
+	assert.True(t, registry.allow("other", policy), "breaker of other agent should be closed")
+	assert.False(t, registry.done("agent", policy, true), "open breaker shouldn't be opened again")
+
+	// Requests are rejected during the probe
+	assert.True(t, registry.probe("agent"), "open breaker should be probed")
+	assert.False(t, registry.allow("agent", policy), "request shouldn't be allowed during the probe")
+	assert.False(t, registry.done("agent", policy, true), "failed probe shouldn't start another probe")
+	assert.False(t, registry.allow("agent", policy), "breaker should be open again after failed probe")
+
+	assert.True(t, registry.probe("agent"), "open breaker should be probed")
+	registry.done("agent", policy, false)
+	assert.True(t, registry.allow("agent", policy), "breaker should be closed after successful probe")
+	assert.False(t, registry.probe("agent"), "closed breaker shouldn't be probed")
+
+	// Disabled breaker
+	assert.True(t, registry.allow("agent", retryPolicy{}), "request should be allowed")
+	assert.False(t, registry.done("disabled", retryPolicy{}, true), "disabled breaker shouldn't be opened")
+}
+
+func TestCallFailsFast(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	var requests int
+	var available bool
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.URL.Path != "/v1/agent/self" {
+			requests++
+		}
+		if !available {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("{}"))
+	})
+	cfg.Controller.ConsulRetries = 5
+	cfg.Controller.ConsulRetryBackoff = time.Second
+	cfg.Controller.ConsulBreakerFailures = 1
+	cfg.Controller.ConsulBreakerTimeout = 10 * time.Millisecond
+
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+	service := &consulapi.AgentServiceRegistration{ID: "id", Name: "name"}
+
+	start := time.Now()
+	assert.Error(t, consulAgent.Register(service))
+	assert.Error(t, consulAgent.Register(service), "request should be rejected by open breaker")
+	assert.True(t, time.Since(start) < time.Second, "failed request shouldn't be retried once breaker is open")
+	mutex.Lock()
+	assert.Equal(t, 1, requests, "only the first request should be sent")
+	available = true
+	mutex.Unlock()
+
+	// Breaker is closed by the probe in background
+	assert.Eventually(t, func() bool {
+		return breakers.allow(consulAgent.Config.Address, consulAgent.retry)
+	}, time.Second, 10*time.Millisecond, "breaker should be closed once the agent is available")
+	assert.NoError(t, consulAgent.Register(service))
+}
+
+func TestCallMaxTotalBackoff(t *testing.T) {
+	t.Parallel()
+
+	var mutex sync.Mutex
+	var requests int
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	cfg.Controller.ConsulRetries = 10
+	cfg.Controller.ConsulRetryBackoff = 50 * time.Millisecond
+	cfg.Controller.ConsulRetryMaxBackoff = 50 * time.Millisecond
+	cfg.Controller.ConsulRetryMaxTotalBackoff = 100 * time.Millisecond
+
+	consulInstance := Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+	assert.Error(t, consulAgent.Register(&consulapi.AgentServiceRegistration{ID: "id", Name: "name"}))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.True(t, requests >= 3 && requests <= 5, "retries should be limited by total backoff, requests: %d", requests)
+}
+
+func TestOrphanedServices(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{Controller: &config.ControllerConfig{CleanOrphanMinRuns: 2}}
+	tracker := make(utils.Orphans)
+
+	orphaned, held := OrphanedServices(cfg, "service", tracker, []string{"a", "b"}, 10)
+	assert.Empty(t, orphaned, "services missing in one run shouldn't be deregistered")
+	assert.Equal(t, []string{"a", "b"}, held)
+
+	orphaned, held = OrphanedServices(cfg, "service", tracker, []string{"a", "b", "c"}, 10)
+	assert.Equal(t, []string{"a", "b"}, orphaned)
+	assert.Equal(t, []string{"c"}, held)
+
+	cfg.Controller.CleanOrphanMinRuns = 1
+	cfg.Controller.CleanMaxDeregistrations = 1
+	orphaned, held = OrphanedServices(cfg, "service", make(utils.Orphans), []string{"a", "b"}, 10)
+	assert.Empty(t, orphaned, "nothing should be deregistered over the limit")
+	assert.Equal(t, []string{"a", "b"}, held)
+}
+
+func TestCleanInactiveNodes(t *testing.T) {
+	t.Parallel()
+
+	var partitions []string
+	var deregistered []string
+	cfg := newTestAgent(t, func(w http.ResponseWriter, r *http.Request) {
+		partitions = append(partitions, r.URL.Query().Get("partition"))
+		switch r.URL.Path {
+		case "/v1/catalog/nodes":
+			json.NewEncoder(w).Encode([]*consulapi.Node{{Node: "node-1"}, {Node: "node-2"}, {Node: "node-3"}})
+		case "/v1/catalog/deregister":
+			var deregistration consulapi.CatalogDeregistration
+			json.NewDecoder(r.Body).Decode(&deregistration)
+			deregistered = append(deregistered, fmt.Sprintf("%s/%s", deregistration.Partition, deregistration.Node))
+		}
+	})
+	cfg.Controller.ConsulPartition = "team"
+	cfg.Controller.CleanOrphanMinRuns = 2
+
+	consulInstance := Adapter{}
+	tracker := make(utils.Orphans)
+	active := map[string]*Adapter{"node-1": nil, "node-2": nil}
+
+	consulInstance.CleanInactiveNodes(cfg, tracker, active)
+	assert.Empty(t, deregistered, "nodes inactive in one run shouldn't be deregistered")
+	consulInstance.CleanInactiveNodes(cfg, tracker, active)
+	assert.Equal(t, []string{"team/node-3"}, deregistered)
+
+	cfg.Controller.CleanOrphanMinRuns = 1
+	cfg.Controller.CleanMaxDeregistrationsRatio = 0.5
+	deregistered = nil
+	consulInstance.CleanInactiveNodes(cfg, make(utils.Orphans), map[string]*Adapter{})
+	assert.Empty(t, deregistered, "nothing should be deregistered over the limit")
+
+	for _, partition := range partitions {
+		assert.Equal(t, "team", partition)
+	}
+}
+
+func TestHold(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAddress:   "localhost",
+			ConsulPort:      "1",
+			ConsulScheme:    "http",
+			RegisterMode:    config.RegisterCatalogMode,
+			CatalogNodeName: "kubernetes",
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+
+	consulInstance := Adapter{}
+	consulInstance.New(cfg, "", "").Hold("", &consulapi.AgentServiceRegistration{ID: "held-id"})
+
+	cfg.Controller.DryRun = true
+	consulAgent := consulInstance.New(cfg, "", "")
+	consulAgent.Hold("", &consulapi.AgentServiceRegistration{ID: "held-id"})
+	consulAgent.Hold("external", &consulapi.AgentServiceRegistration{ID: "held-external-id"})
+	consulAgent.Hold("held-node", nil)
+
+	var operations []string
+	for _, operation := range DryRunPlan.Operations() {
+		if operation.ServiceID == "held-id" || operation.ServiceID == "held-external-id" || operation.Node == "held-node" {
+			operations = append(operations, fmt.Sprintf("%s %s %s %s", operation.Operation, operation.Change, operation.Node, operation.ServiceID))
+		}
+	}
+	assert.Equal(t, []string{
+		"deregister held kubernetes held-id",
+		"deregister held external held-external-id",
+		"deregister_node held held-node ",
+	}, operations, "held deregistrations should be recorded only in dry-run mode")
 }
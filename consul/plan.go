@@ -0,0 +1,189 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// "ChangeAdd", "ChangeUpdate", "ChangeRemove" and "ChangeNone" defines kind of change
+// which the recorded operation makes in Consul.
+// "ChangeAdd" - service doesn't exist in Consul.
+// "ChangeUpdate" - service exists in Consul, but differs.
+// "ChangeRemove" - service or node is removed from Consul.
+// "ChangeNone" - service exists in Consul and doesn't differ.
+// "ChangeHeld" - service is missing in Kubernetes, but cleaning holds back its removal, e.g. because of
+// `clean_orphan_min_runs` option or the limit of deregistrations.
+const (
+	ChangeAdd    = "add"
+	ChangeUpdate = "update"
+	ChangeRemove = "remove"
+	ChangeNone   = "none"
+	ChangeHeld   = "held"
+)
+
+// Operation describes the operation on Consul which is recorded instead of executed in dry-run mode
+type Operation struct {
+	Time          time.Time                           `json:"time"`
+	Operation     string                              `json:"operation"`
+	Change        string                              `json:"change"`
+	ConsulAddress string                              `json:"consul_address"`
+	Node          string                              `json:"node,omitempty"`
+	ServiceID     string                              `json:"service_id,omitempty"`
+	Service       *consulapi.AgentServiceRegistration `json:"service,omitempty"`
+}
+
+// Plan keeps operations on Consul recorded in dry-run mode.
+// Only the last occurrence of the same operation on the same service is kept.
+type Plan struct {
+	mutex      sync.Mutex
+	keys       []string
+	operations map[string]Operation
+}
+
+// DryRunPlan is the plan which operations of all Consul Adapters are recorded in
+var DryRunPlan = &Plan{operations: make(map[string]Operation)}
+
+// Record adds operation to the plan
+func (p *Plan) Record(operation Operation) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := fmt.Sprintf("%s/%s/%s/%s", operation.Operation, operation.ConsulAddress, operation.Node, operation.ServiceID)
+	if _, ok := p.operations[key]; !ok {
+		p.keys = append(p.keys, key)
+	}
+	p.operations[key] = operation
+	glog.Infof("[dry-run] %s service %s in %s (%s), node: %s", operation.Operation, operation.ServiceID, operation.ConsulAddress, operation.Change, operation.Node)
+}
+
+// Operations returns recorded operations in order of their first occurrence
+func (p *Plan) Operations() []Operation {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	operations := make([]Operation, 0, len(p.keys))
+	for _, key := range p.keys {
+		operations = append(operations, p.operations[key])
+	}
+	return operations
+}
+
+// ServeHTTP writes recorded operations as JSON
+func (p *Plan) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(p.Operations())
+	if err != nil {
+		glog.Errorf("Can't encode dry-run plan: %s", err)
+	}
+}
+
+// record records operation in dry-run plan and returns true if the Adapter works in dry-run mode
+func (c *Adapter) record(operation string, node string, service *consulapi.AgentServiceRegistration) bool {
+	if !c.dryRun {
+		return false
+	}
+
+	o := c.newOperation(operation, node, service)
+	switch operation {
+	case "register":
+		o.Change = c.change(node, service)
+	case "deregister", "deregister_node":
+		o.Change = ChangeRemove
+	default:
+		o.Change = ChangeUpdate
+	}
+
+	DryRunPlan.Record(o)
+	return true
+}
+
+// Hold records in dry-run mode deregistration of service which cleaning holds back, node is the node
+// in Consul catalog which service is registered on, empty value means the node of the Adapter.
+// Nil service means deregistration of the synthetic node itself.
+func (c *Adapter) Hold(node string, service *consulapi.AgentServiceRegistration) {
+	if !c.dryRun {
+		return
+	}
+	if node == "" {
+		node = c.catalogNode
+	}
+
+	operation := "deregister"
+	if service == nil {
+		operation = "deregister_node"
+	}
+	o := c.newOperation(operation, node, service)
+	o.Change = ChangeHeld
+	DryRunPlan.Record(o)
+}
+
+func (c *Adapter) newOperation(operation string, node string, service *consulapi.AgentServiceRegistration) Operation {
+	o := Operation{
+		Time:          time.Now(),
+		Operation:     operation,
+		ConsulAddress: c.Config.Address,
+		Node:          node,
+		Service:       service,
+	}
+	if service != nil {
+		o.ServiceID = service.ID
+	}
+	return o
+}
+
+// change returns kind of change which registration of service makes in Consul, only the service
+// and its checks are queried on the node with given name in Consul catalog or in Consul Agent if node is empty
+func (c *Adapter) change(node string, service *consulapi.AgentServiceRegistration) string {
+	registered, err := c.registeredService(node, service)
+	if err != nil {
+		glog.Errorf("Can't get service %s from Consul: %s", service.ID, err)
+		return ChangeAdd
+	}
+	if registered == nil {
+		return ChangeAdd
+	}
+
+	options := c.queryOptions(service)
+	options.Filter = fmt.Sprintf("ServiceID == %q", service.ID)
+	checks, err := c.serviceChecks(node, options)
+	if err != nil {
+		glog.Errorf("Can't get checks from Consul: %s", err)
+		return ChangeUpdate
+	}
+
+	if len(ServiceDrift(service, registered, checks[service.ID])) > 0 {
+		return ChangeUpdate
+	}
+	return ChangeNone
+}
+
+// registeredService returns service with ID of given service registered on the node with given name
+// in Consul catalog or in Consul Agent if node is empty, nil is returned if service isn't registered
+func (c *Adapter) registeredService(node string, service *consulapi.AgentServiceRegistration) (*consulapi.AgentService, error) {
+	options := c.queryOptions(service)
+	options.Filter = fmt.Sprintf("ID == %q", service.ID)
+
+	var services map[string]*consulapi.AgentService
+	err := c.call(func() error {
+		if node == "" {
+			var err error
+			services, err = c.client.Agent().ServicesWithFilterOpts(options.Filter, options)
+			return err
+		}
+		catalogNode, _, err := c.client.Catalog().Node(node, options)
+		if catalogNode != nil {
+			services = catalogNode.Services
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return services[service.ID], nil
+}
@@ -0,0 +1,225 @@
+package consul
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/metrics"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+	cleanhttp "github.com/hashicorp/go-cleanhttp"
+)
+
+// clientSettings describes the configuration which Consul client is built from
+type clientSettings struct {
+	address            string
+	token              string
+	namespace          string
+	namespaceMirroring bool
+	partition          string
+	timeout            time.Duration
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+}
+
+// pooledClient is Consul client kept in the pool together with its configuration
+type pooledClient struct {
+	client   *consulapi.Client
+	config   *consulapi.Config
+	settings clientSettings
+	// tlsModTime is the latest modification time of TLS files when the client was built
+	tlsModTime time.Time
+	lastUsed   time.Time
+}
+
+// clientPool caches Consul clients by address of Consul Agent. Client is built again
+// only if its settings or TLS files have changed, clients which haven't been used
+// for longer than idle timeout are evicted.
+type clientPool struct {
+	mutex   sync.Mutex
+	clients map[string]*pooledClient
+	// token replaces `consul_token` option after rotation of token
+	token string
+}
+
+var clients = &clientPool{clients: make(map[string]*pooledClient)}
+
+func newClientSettings(cfg *config.Config, address string) clientSettings {
+	settings := clientSettings{
+		address:            address,
+		token:              cfg.Controller.ConsulToken,
+		namespace:          cfg.Controller.ConsulNamespace,
+		namespaceMirroring: cfg.Controller.ConsulNamespaceMirroring,
+		partition:          cfg.Controller.ConsulPartition,
+		timeout:            cfg.Controller.ConsulTimeout,
+	}
+	if strings.HasPrefix(address, "https://") {
+		settings.caFile = cfg.Controller.ConsulCAFile
+		settings.certFile = cfg.Controller.ConsulCertFile
+		settings.keyFile = cfg.Controller.ConsulKeyFile
+		settings.insecureSkipVerify = cfg.Controller.ConsulInsecureSkipVerify
+	}
+	return settings
+}
+
+// get returns Consul client for given address from the pool, the client is built if needed
+func (p *clientPool) get(cfg *config.Config, address string) *pooledClient {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	p.evict(now, cfg.Controller.ConsulClientIdleTimeout)
+
+	settings := newClientSettings(cfg, address)
+	if p.token != "" {
+		settings.token = p.token
+	}
+	tlsModTime := settings.tlsModTime()
+
+	if pooled, ok := p.clients[address]; ok {
+		if pooled.settings == settings && pooled.tlsModTime.Equal(tlsModTime) {
+			pooled.lastUsed = now
+			return pooled
+		}
+		glog.V(2).Infof("Configuration of Consul client for %s has changed, building client again", address)
+		closeIdleConnections(pooled)
+	}
+
+	client, consulConfig := newClient(cfg.Consul, settings)
+	pooled := &pooledClient{
+		client:     client,
+		config:     consulConfig,
+		settings:   settings,
+		tlsModTime: tlsModTime,
+		lastUsed:   now,
+	}
+	p.clients[address] = pooled
+	return pooled
+}
+
+// SetToken sets Consul ACL token which is used by all Consul clients instead of `consul_token` option.
+// Cached clients are built again with the new token when they're used next time.
+func SetToken(token string) {
+	clients.mutex.Lock()
+	defer clients.mutex.Unlock()
+
+	if token == "" || token == clients.token {
+		return
+	}
+	clients.token = token
+	metrics.ConsulTokenRotation.SetToCurrentTime()
+	glog.Info("Consul ACL token has been rotated")
+}
+
+// evict removes clients which haven't been used for longer than idle timeout
+func (p *clientPool) evict(now time.Time, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		return
+	}
+	for address, pooled := range p.clients {
+		if now.Sub(pooled.lastUsed) > idleTimeout {
+			glog.V(2).Infof("Evicting idle Consul client for %s", address)
+			closeIdleConnections(pooled)
+			delete(p.clients, address)
+		}
+	}
+}
+
+func closeIdleConnections(pooled *pooledClient) {
+	if pooled.config.HttpClient != nil {
+		pooled.config.HttpClient.CloseIdleConnections()
+	}
+}
+
+// tlsModTime returns the latest modification time of TLS files
+func (s clientSettings) tlsModTime() time.Time {
+	var modTime time.Time
+	for _, file := range []string{s.caFile, s.certFile, s.keyFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime
+}
+
+// newClient builds Consul client from a copy of base configuration, base configuration is not changed
+func newClient(base *consulapi.Config, settings clientSettings) (*consulapi.Client, *consulapi.Config) {
+	consulConfig := *base
+
+	uri, err := url.Parse(settings.address)
+	if err != nil {
+		glog.Fatalf("bad adapter uri: ")
+	}
+
+	switch uri.Scheme {
+	case "consul-unix":
+		consulConfig.HttpClient = &http.Client{}
+		consulConfig.Address = strings.TrimPrefix(uri.String(), "consul-")
+
+	case "https":
+		tlsConfigDesc := &consulapi.TLSConfig{
+			Address:            uri.Host,
+			CAFile:             settings.caFile,
+			CertFile:           settings.certFile,
+			KeyFile:            settings.keyFile,
+			InsecureSkipVerify: settings.insecureSkipVerify,
+		}
+		tlsConfig, err := consulapi.SetupTLSConfig(tlsConfigDesc)
+		if err != nil {
+			glog.Fatalf("Cannot set up Consul TLSConfig: %s", err)
+		}
+		consulConfig.Scheme = uri.Scheme
+		transport := cleanhttp.DefaultPooledTransport()
+		transport.TLSClientConfig = tlsConfig
+		consulConfig.HttpClient = &http.Client{
+			Transport: transport,
+		}
+		consulConfig.Address = uri.Host
+
+	default:
+		consulConfig.HttpClient = &http.Client{
+			Transport: cleanhttp.DefaultPooledTransport(),
+		}
+		consulConfig.Address = uri.Host
+	}
+
+	// Add Token
+	if settings.token != "" {
+		consulConfig.Token = settings.token
+	}
+
+	// Consul Enterprise namespace and admin partition,
+	// in mirroring mode namespace is taken from registration of service
+	if settings.namespaceMirroring {
+		consulConfig.Namespace = ""
+	} else if settings.namespace != "" {
+		consulConfig.Namespace = settings.namespace
+	}
+	if settings.partition != "" {
+		consulConfig.Partition = settings.partition
+	}
+
+	//Timeout
+	consulConfig.HttpClient.Timeout = settings.timeout
+
+	client, err := consulapi.NewClient(&consulConfig)
+	if err != nil {
+		glog.Fatalf("consul: %s", uri.Scheme)
+	}
+	return client, &consulConfig
+}
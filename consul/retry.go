@@ -0,0 +1,210 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/metrics"
+
+	"github.com/golang/glog"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// "breakerClosed", "breakerOpen" and "breakerHalfOpen" defines state of circuit breaker of Consul Agent.
+// "breakerClosed" - requests are sent to Consul Agent.
+// "breakerOpen" - requests are rejected without calling Consul Agent, the agent is probed in background.
+// "breakerHalfOpen" - requests are rejected while the probe checks whether Consul Agent is available again.
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// retryPolicy describes retries of requests to Consul Agent and its circuit breaker
+type retryPolicy struct {
+	retries         int
+	backoff         time.Duration
+	maxBackoff      time.Duration
+	maxTotalBackoff time.Duration
+	breakerFailures int
+	breakerTimeout  time.Duration
+}
+
+func newRetryPolicy(cfg *config.Config) retryPolicy {
+	return retryPolicy{
+		retries:         cfg.Controller.ConsulRetries,
+		backoff:         cfg.Controller.ConsulRetryBackoff,
+		maxBackoff:      cfg.Controller.ConsulRetryMaxBackoff,
+		maxTotalBackoff: cfg.Controller.ConsulRetryMaxTotalBackoff,
+		breakerFailures: cfg.Controller.ConsulBreakerFailures,
+		breakerTimeout:  cfg.Controller.ConsulBreakerTimeout,
+	}
+}
+
+// delay returns time to wait before the next attempt, exponential backoff is limited
+// by the maximum backoff and a random jitter of up to half of the backoff is subtracted
+func (p retryPolicy) delay(attempt int) time.Duration {
+	backoff := p.backoff
+	for i := 0; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if p.maxBackoff > 0 && backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff - time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// breaker keeps state of circuit breaker of Consul Agent
+type breaker struct {
+	state    int
+	failures int
+}
+
+// breakerRegistry keeps circuit breakers by address of Consul Agent
+type breakerRegistry struct {
+	mutex    sync.Mutex
+	breakers map[string]*breaker
+}
+
+var breakers = &breakerRegistry{breakers: make(map[string]*breaker)}
+
+// allow checks whether request can be sent to Consul Agent, i.e. its circuit breaker is closed
+func (r *breakerRegistry) allow(address string, policy retryPolicy) bool {
+	if policy.breakerFailures <= 0 {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.breakers[address]
+	return !ok || b.state == breakerClosed
+}
+
+// done updates circuit breaker with result of request to Consul Agent.
+// It returns true if the breaker has been opened by the request, i.e. Consul Agent should be probed.
+func (r *breakerRegistry) done(address string, policy retryPolicy, failed bool) bool {
+	if policy.breakerFailures <= 0 {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.breakers[address]
+	if !ok {
+		b = &breaker{}
+		r.breakers[address] = b
+	}
+
+	if !failed {
+		b.failures = 0
+		if b.state != breakerClosed {
+			glog.Infof("Consul Agent %s is available again", address)
+		}
+		r.setState(address, b, breakerClosed)
+		return false
+	}
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		r.setState(address, b, breakerOpen)
+	case b.state == breakerClosed && b.failures >= policy.breakerFailures:
+		glog.Warningf("Consul Agent %s has failed %d times, requests are stopped until the agent is available", address, b.failures)
+		r.setState(address, b, breakerOpen)
+		return true
+	}
+	return false
+}
+
+// probe marks open circuit breaker as half-open before the probe of Consul Agent.
+// It returns false if the breaker isn't open anymore, i.e. the probe isn't needed.
+func (r *breakerRegistry) probe(address string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	b, ok := r.breakers[address]
+	if !ok || b.state != breakerOpen {
+		return false
+	}
+	r.setState(address, b, breakerHalfOpen)
+	return true
+}
+
+func (r *breakerRegistry) setState(address string, b *breaker, state int) {
+	b.state = state
+	metrics.ConsulBreakerState.WithLabelValues(address).Set(float64(state))
+}
+
+// isRetryable checks whether request which has failed with given error can be repeated.
+// Requests rejected by Consul, e.g. because of invalid registration or ACL, are not repeated.
+func isRetryable(err error) bool {
+	var statusErr consulapi.StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= http.StatusInternalServerError || statusErr.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// call sends request to Consul Agent, failed request is repeated according to retry policy.
+// Request isn't sent if circuit breaker of Consul Agent is open. Requests are sent while controller
+// holds its lock, so the total time of backoff is limited and retries stop once the breaker is open.
+func (c *Adapter) call(request func() error) error {
+	address := c.Config.Address
+
+	var waited time.Duration
+	for attempt := 0; ; attempt++ {
+		if !breakers.allow(address, c.retry) {
+			return fmt.Errorf("circuit breaker of Consul Agent %s is open", address)
+		}
+
+		err := request()
+		retryable := err != nil && isRetryable(err)
+		if breakers.done(address, c.retry, retryable) {
+			go c.probe(address)
+		}
+		if !retryable || attempt >= c.retry.retries || !breakers.allow(address, c.retry) {
+			return err
+		}
+
+		delay := c.retry.delay(attempt)
+		if c.retry.maxTotalBackoff > 0 && waited+delay > c.retry.maxTotalBackoff {
+			glog.V(2).Infof("Request to Consul Agent %s has failed: %s, time of retries is exhausted", address, err)
+			return err
+		}
+		waited += delay
+
+		glog.V(2).Infof("Request to Consul Agent %s has failed: %s, retrying in %s", address, err, delay)
+		metrics.ConsulRetries.WithLabelValues(address).Inc()
+		time.Sleep(delay)
+	}
+}
+
+// probe checks in background whether Consul Agent with open circuit breaker is available again,
+// the agent is probed every `consul_breaker_timeout` until it responds and the breaker is closed
+func (c *Adapter) probe(address string) {
+	client, policy := c.client, c.retry
+	for {
+		time.Sleep(policy.breakerTimeout)
+		if !breakers.probe(address) {
+			return
+		}
+
+		glog.Infof("Probing Consul Agent %s", address)
+		_, err := client.Agent().Self()
+		failed := err != nil && isRetryable(err)
+		breakers.done(address, policy, failed)
+		if !failed {
+			return
+		}
+	}
+}
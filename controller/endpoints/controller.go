@@ -2,7 +2,9 @@ package endpoints
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,24 +25,55 @@ import (
 )
 
 // These are valid annotations names which are take into account.
+// Annotations can be set on Endpoints or on Service which owns the Endpoints,
+// in case when both are set the annotation of Service takes precedence.
 // "ConsulRegisterEnabledAnnotation" is a name of annotation key for `enabled` option.
+// "ConsulRegisterServiceNameAnnotation" is a name of annotation key for `service.name` option.
+// "ConsulRegisterServiceTagsAnnotation" is a name of annotation key for `service.tags` option.
+// "ConsulRegisterServiceMetaPrefixAnnotation" is a prefix name of annotation key for `service.meta` option.
+// "ConsulRegisterServiceWeightAnnotation" is a name of annotation key for `service.weight` option,
+// weights of service in format `<passing>[,<warning>]`.
+// "ConsulRegisterServicePortPrefixAnnotation" is a prefix name of annotation key which maps
+// a named port to the name of Consul service.
+// "ConsulRegisterServiceCheckTypeAnnotation" is a name of annotation key for `service.check.type` option.
+// "ConsulRegisterServiceCheckPathAnnotation" is a name of annotation key for `service.check.path` option.
+// "ConsulRegisterServiceCheckIntervalAnnotation" is a name of annotation key for `service.check.interval` option.
+// "ConsulRegisterServiceCheckTimeoutAnnotation" is a name of annotation key for `service.check.timeout` option.
 const (
-	ConsulRegisterEnabledAnnotation string = "consul.register/enabled"
+	ConsulRegisterEnabledAnnotation              string = "consul.register/enabled"
+	ConsulRegisterServiceNameAnnotation          string = "consul.register/service.name"
+	ConsulRegisterServiceTagsAnnotation          string = "consul.register/service.tags"
+	ConsulRegisterServiceMetaPrefixAnnotation    string = "consul.register/service.meta."
+	ConsulRegisterServiceWeightAnnotation        string = "consul.register/service.weight"
+	ConsulRegisterServicePortPrefixAnnotation    string = "consul.register/service.port."
+	ConsulRegisterServiceCheckTypeAnnotation     string = "consul.register/service.check.type"
+	ConsulRegisterServiceCheckPathAnnotation     string = "consul.register/service.check.path"
+	ConsulRegisterServiceCheckIntervalAnnotation string = "consul.register/service.check.interval"
+	ConsulRegisterServiceCheckTimeoutAnnotation  string = "consul.register/service.check.timeout"
 )
 
 var (
 	addedEndpoints = make(map[types.UID]bool)
+	// orphans counts consecutive runs of cleaning in which services are missing in Kubernetes,
+	// nodeOrphans counts runs in which synthetic nodes of `catalog` mode are inactive
+	orphans     = make(utils.Orphans)
+	nodeOrphans = make(utils.Orphans)
+	// registeredServices keeps the last registered services, service is updated in place when it changes
+	registeredServices = make(map[string]*consulapi.AgentServiceRegistration)
 
 	consulAgents map[string]*consul.Adapter
 )
 
 // Controller describes the attributes that are uses by Controller
 type Controller struct {
-	clientset      *kubernetes.Clientset
+	clientset      kubernetes.Interface
 	consulInstance consul.Adapter
 	cfg            *config.Config
 	namespace      string
 	mutex          *sync.Mutex
+	// services keeps Services which own Endpoints, it's the store of Services' watch once it has synced
+	services        cache.Store
+	servicesWatched bool
 }
 
 // New creates an instance of controller
@@ -50,7 +83,8 @@ func New(clientset *kubernetes.Clientset, consulInstance consul.Adapter, cfg *co
 		consulInstance: consulInstance,
 		cfg:            cfg,
 		namespace:      namespace,
-		mutex:          &sync.Mutex{}}
+		mutex:          &sync.Mutex{},
+		services:       cache.NewStore(cache.MetaNamespaceKeyFunc)}
 }
 
 func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
@@ -69,8 +103,7 @@ func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
 		}
 
 		for _, node := range nodes.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+			consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
 			consulAgents[node.ObjectMeta.Name] = consulAgent
 		}
 	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
@@ -81,10 +114,24 @@ func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
 			return consulAgents, err
 		}
 		for _, pod := range pods.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			consulAgent := c.consulInstance.New(c.cfg, pod.Spec.NodeName, pod.Status.HostIP)
 			consulAgents[pod.Status.HostIP] = consulAgent
 		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Node for services which are not bound to Kubernetes node, or for all services in `cluster` mode
+		consulAgents[c.cfg.Controller.CatalogNodeName] = c.consulInstance.New(c.cfg, "", "")
+
+		if c.cfg.Controller.CatalogNodeMode == config.CatalogNodePerNode {
+			nodes, err := c.clientset.CoreV1().Nodes().List(v1.ListOptions{})
+			if err != nil {
+				return consulAgents, err
+			}
+
+			for _, node := range nodes.Items {
+				consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+				consulAgents[node.ObjectMeta.Name] = consulAgent
+			}
+		}
 	}
 
 	return consulAgents, nil
@@ -112,13 +159,18 @@ func (c *Controller) Clean() error {
 		return err
 	}
 
+	if err := c.refreshServices(); err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+
 	endpoints, err := c.clientset.CoreV1().Endpoints("").List(v1.ListOptions{})
 	if err != nil {
 		return err
 	}
 
 	for _, endpoint := range endpoints.Items {
-		if !isRegisterEnabled(&endpoint) {
+		if !isRegisterEnabled(&endpoint, c.getAnnotations(&endpoint)) {
 			continue
 		}
 
@@ -130,29 +182,43 @@ func (c *Controller) Clean() error {
 	}
 
 	// Remove useless services
+	var missing []string
 	for uid, services := range registeredEndpoints {
 		if _, ok := addedEndpoints[types.UID(uid)]; !ok {
 			for _, serviceID := range services {
-				glog.Infof("Deletion of endpoint with UID %s (POD: %s)", uid, serviceID)
-				// check if there consul agent instance
-				if _, ok := addedConsulServices[serviceID]; !ok {
-					glog.Warningf("Cannot find Consul Agent Instance for service with ID: %s", serviceID)
-					continue
-				}
-				service := &consulapi.AgentServiceRegistration{ID: serviceID}
-				err := consulAgents[addedConsulServices[serviceID]].Deregister(service)
-				if err != nil {
-					glog.Errorf("Can't deregister service: %s", err)
-					continue
-				}
-				glog.Infof("Service's been deregistered, ID: %s", service.ID)
-				glog.V(2).Infof("%#v", service)
-				delete(addedConsulServices, service.ID)
-
+				glog.V(2).Infof("Endpoint with UID %s (POD: %s) is missing", uid, serviceID)
+				missing = append(missing, serviceID)
 			}
-			delete(addedEndpoints, types.UID(uid))
 		}
 	}
+	orphaned, held := consul.OrphanedServices(c.cfg, "endpoints", orphans, missing, len(addedConsulServices))
+	for _, serviceID := range held {
+		if consulAgent, ok := consulAgents[addedConsulServices[serviceID]]; ok {
+			consulAgent.Hold("", &consulapi.AgentServiceRegistration{ID: serviceID})
+		}
+	}
+	for _, serviceID := range orphaned {
+		glog.Infof("Deletion of endpoint's service with ID: %s", serviceID)
+		// check if there consul agent instance
+		if _, ok := addedConsulServices[serviceID]; !ok {
+			glog.Warningf("Cannot find Consul Agent Instance for service with ID: %s", serviceID)
+			continue
+		}
+		service := &consulapi.AgentServiceRegistration{ID: serviceID}
+		err := consulAgents[addedConsulServices[serviceID]].Deregister(service)
+		if err != nil {
+			glog.Errorf("Can't deregister service: %s", err)
+			continue
+		}
+		glog.Infof("Service's been deregistered, ID: %s", service.ID)
+		glog.V(2).Infof("%#v", service)
+		delete(addedConsulServices, service.ID)
+		delete(registeredServices, service.ID)
+	}
+
+	if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		c.consulInstance.CleanInactiveNodes(c.cfg, nodeOrphans, consulAgents)
+	}
 
 	c.mutex.Unlock()
 	return nil
@@ -182,13 +248,18 @@ func (c *Controller) Sync() error {
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
+	if err := c.refreshServices(); err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+
 	endpoints, err := c.clientset.CoreV1().Endpoints("").List(v1.ListOptions{})
 	if err != nil {
 		return err
 	}
 
 	for _, endpoint := range endpoints.Items {
-		if !isRegisterEnabled(&endpoint) {
+		if !isRegisterEnabled(&endpoint, c.getAnnotations(&endpoint)) {
 			continue
 		}
 
@@ -203,6 +274,8 @@ func (c *Controller) Sync() error {
 
 // Watch watches events in K8S cluster
 func (c *Controller) Watch() {
+	c.watchServices()
+
 	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "endpoints", c.namespace,
 		fields.Everything())
 	_, controller := cache.NewInformer(
@@ -214,32 +287,33 @@ func (c *Controller) Watch() {
 				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("delete"))
 				defer timer.ObserveDuration()
 
-				if !isRegisterEnabled(obj) {
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+
+				if !isRegisterEnabled(obj.(*v1.Endpoints), c.getAnnotations(obj.(*v1.Endpoints))) {
 					return
 				}
 
-				c.mutex.Lock()
 				glog.Info("Endpoint deletion")
 				if err := c.eventDeleteFunc(obj); err != nil {
 					glog.Errorf("Failed to delete endpoints: %s", err)
 				}
-				c.mutex.Unlock()
 			},
 			UpdateFunc: func(oldObj, newObj interface{}) {
 				timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("update"))
 				defer timer.ObserveDuration()
 
-				if !isRegisterEnabled(newObj) {
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+
+				if !isRegisterEnabled(newObj.(*v1.Endpoints), c.getAnnotations(newObj.(*v1.Endpoints))) {
 					return
 				}
 
-				c.mutex.Lock()
 				glog.Info("Endpoint updation")
 				if err := c.eventUpdateFunc(oldObj, newObj); err != nil {
 					glog.Errorf("Failed to update endpoints: %s", err)
 				}
-				c.mutex.Unlock()
-
 			},
 		},
 	)
@@ -248,6 +322,104 @@ func (c *Controller) Watch() {
 	controller.Run(stop)
 }
 
+// watchServices starts watch of Services which own Endpoints and waits until it has synced,
+// afterwards annotations of Services are taken from the store of the watch.
+// Endpoints are synchronized again when annotations of their Service change.
+func (c *Controller) watchServices() {
+	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "services", c.namespace,
+		fields.Everything())
+	store, controller := cache.NewInformer(
+		watchlist,
+		&v1.Service{},
+		time.Second*0,
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldService := oldObj.(*v1.Service)
+				newService := newObj.(*v1.Service)
+				if reflect.DeepEqual(oldService.ObjectMeta.Annotations, newService.ObjectMeta.Annotations) {
+					return
+				}
+
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+				c.serviceUpdateFunc(oldService, newService)
+			},
+			DeleteFunc: func(obj interface{}) {
+				// Endpoints can outlive their Service for a while, they're deregistered
+				// with annotations of the deleted Service
+				service, ok := obj.(*v1.Service)
+				if !ok {
+					return
+				}
+
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+				c.serviceUpdateFunc(service, nil)
+			},
+		},
+	)
+
+	stop := make(chan struct{})
+	go controller.Run(stop)
+
+	for !controller.HasSynced() {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	c.mutex.Lock()
+	c.services = store
+	c.servicesWatched = true
+	c.mutex.Unlock()
+}
+
+// serviceUpdateFunc synchronizes Endpoints owned by Service whose annotations have changed, new Service
+// is nil if it's been deleted. Services of Endpoints are deregistered if registration has been disabled.
+func (c *Controller) serviceUpdateFunc(oldService *v1.Service, newService *v1.Service) {
+	namespace, name := oldService.ObjectMeta.Namespace, oldService.ObjectMeta.Name
+	endpoint, err := c.clientset.CoreV1().Endpoints(namespace).Get(name)
+	if err != nil {
+		glog.V(2).Infof("Can't get endpoints %s/%s: %s", namespace, name, err)
+		return
+	}
+
+	if !isRegisterEnabled(endpoint, mergeAnnotations(endpoint, newService)) {
+		if isRegisterEnabled(endpoint, mergeAnnotations(endpoint, oldService)) {
+			glog.Infof("Registration of endpoint %s/%s has been disabled by service", namespace, name)
+			if err := c.eventDeleteFunc(endpoint); err != nil {
+				glog.Errorf("Failed to delete endpoints: %s", err)
+			}
+		}
+		return
+	}
+	if newService == nil {
+		return
+	}
+
+	glog.Infof("Annotations of service %s/%s have changed", namespace, name)
+	if err := c.eventUpdateFunc(endpoint, endpoint); err != nil {
+		glog.Errorf("Failed to update endpoints: %s", err)
+	}
+}
+
+// refreshServices lists Services which own Endpoints until the watch of Services has synced,
+// e.g. during the first synchronization or in `plan` subcommand
+func (c *Controller) refreshServices() error {
+	if c.servicesWatched {
+		return nil
+	}
+
+	services, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("Can't list services: %s", err)
+	}
+
+	var items []interface{}
+	for i := range services.Items {
+		items = append(items, &services.Items[i])
+	}
+	return c.services.Replace(items, services.ResourceVersion)
+}
+
 // getAddedConsulServices returns the list of added Consul Services
 func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]string, error) {
 	var addedServices = make(map[string]string)
@@ -261,7 +433,7 @@ func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]s
 		} else {
 			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
 			for _, service := range services {
-				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) {
+				if consul.IsOwned(c.cfg, service.Tags, service.Meta) {
 					addedServices[service.ID] = consulAgentID
 
 					uid := utils.GetConsulServiceTag(service.Tags, "uid")
@@ -277,9 +449,12 @@ func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]s
 	return addedServices, registeredConsulServices, nil
 }
 
-func (c *Controller) deleteEndpoint(nodeName, podIP, serviceID string) {
+func (c *Controller) deleteEndpoint(nodeName, podIP, namespace, serviceID string) {
 	consulAgent := c.consulInstance.New(c.cfg, nodeName, podIP)
-	service := &consulapi.AgentServiceRegistration{ID: serviceID}
+	service := &consulapi.AgentServiceRegistration{
+		ID:        serviceID,
+		Namespace: consul.Namespace(c.cfg, namespace),
+	}
 	err := consulAgent.Deregister(service)
 	if err != nil {
 		glog.Errorf("Can't deregister service: %s", err)
@@ -288,6 +463,7 @@ func (c *Controller) deleteEndpoint(nodeName, podIP, serviceID string) {
 		metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
 		glog.Infof("Service's been deregistered, ID: %s", service.ID)
 		glog.V(2).Infof("%#v", service)
+		delete(registeredServices, service.ID)
 	}
 }
 
@@ -303,8 +479,8 @@ func (c *Controller) eventDeleteFunc(obj interface{}) error {
 			}
 			ports := subset.Ports
 			for _, port := range ports {
-				serviceID := fmt.Sprintf("%s-%d", address.TargetRef.Name, port.Port)
-				c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, serviceID)
+				serviceID := getServiceID(address.TargetRef.Name, port, ports)
+				c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, obj.(*v1.Endpoints).ObjectMeta.Namespace, serviceID)
 			}
 			delete(addedEndpoints, address.TargetRef.UID)
 		}
@@ -335,14 +511,27 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 				}
 				ports := subsetOld.Ports
 				for _, port := range ports {
-					serviceID := fmt.Sprintf("%s-%d", addressOld.TargetRef.Name, port.Port)
-					c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, serviceID)
+					serviceID := getServiceID(addressOld.TargetRef.Name, port, ports)
+					c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, newObj.(*v1.Endpoints).ObjectMeta.Namespace, serviceID)
 				}
 				delete(addedAddresses, addressOld.TargetRef.UID)
 			}
 		}
 	}
 
+	// Deregister services of ports which have been removed from addresses kept by the update
+	for serviceID, address := range getRemovedServiceIDs(oldObj.(*v1.Endpoints), newObj.(*v1.Endpoints)) {
+		glog.Infof("Port of endpoint with UID %s (POD: %s) has been removed, service ID: %s", address.TargetRef.UID, address.TargetRef.Name, serviceID)
+
+		pod, err := c.getPod(address.TargetRef.Namespace, address.TargetRef.Name)
+		if err != nil {
+			return err
+		}
+		c.deleteEndpoint(pod.Spec.NodeName, pod.Status.PodIP, newObj.(*v1.Endpoints).ObjectMeta.Namespace, serviceID)
+	}
+
+	annotations := c.getAnnotations(newObj.(*v1.Endpoints))
+
 	// Register new endpoint
 	for _, subset := range newObj.(*v1.Endpoints).Subsets {
 		for _, address := range subset.Addresses {
@@ -357,7 +546,7 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 				ports := subset.Ports
 				for _, port := range ports {
 					// Convert endpoint to Consul's service
-					service, err := c.createConsulService(newObj.(*v1.Endpoints), address, port)
+					service, err := c.createConsulService(newObj.(*v1.Endpoints), annotations, address, port, ports)
 					if err != nil {
 						glog.Errorf("Can't convert endpoint to Consul's service: %s", err)
 						metrics.PodFailure.WithLabelValues("update").Inc()
@@ -373,9 +562,12 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 						glog.Infof("Service's been registered, Name: %s, ID: %s", service.Name, service.ID)
 						glog.V(2).Infof("%#v", service)
 						addedEndpoints[address.TargetRef.UID] = true
+						registeredServices[service.ID] = service
 						metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
 					}
 				}
+			} else {
+				c.updateService(newObj.(*v1.Endpoints), annotations, address, subset.Ports)
 			}
 		}
 	}
@@ -384,6 +576,74 @@ func (c *Controller) eventUpdateFunc(oldObj interface{}, newObj interface{}) err
 	return nil
 }
 
+// getRemovedServiceIDs returns IDs of Consul services of addresses which appear in both old and new Endpoints,
+// but whose ports don't appear in new Endpoints anymore, together with the address.
+// Services of addresses which have been removed entirely aren't returned.
+func getRemovedServiceIDs(oldEndpoints, newEndpoints *v1.Endpoints) map[string]v1.EndpointAddress {
+	var removed = make(map[string]v1.EndpointAddress)
+	var serviceIDs = make(map[types.UID]map[string]bool)
+
+	for _, subset := range newEndpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if _, ok := serviceIDs[address.TargetRef.UID]; !ok {
+				serviceIDs[address.TargetRef.UID] = make(map[string]bool)
+			}
+			for _, port := range subset.Ports {
+				serviceIDs[address.TargetRef.UID][getServiceID(address.TargetRef.Name, port, subset.Ports)] = true
+			}
+		}
+	}
+
+	for _, subset := range oldEndpoints.Subsets {
+		for _, address := range subset.Addresses {
+			current, ok := serviceIDs[address.TargetRef.UID]
+			if !ok {
+				continue
+			}
+			for _, port := range subset.Ports {
+				serviceID := getServiceID(address.TargetRef.Name, port, subset.Ports)
+				if !current[serviceID] {
+					removed[serviceID] = address
+				}
+			}
+		}
+	}
+	return removed
+}
+
+// updateService registers services of endpoint address once again if their registrations have changed.
+// Consul Agent updates registered service in place.
+func (c *Controller) updateService(endpoint *v1.Endpoints, annotations map[string]string, address v1.EndpointAddress, ports []v1.EndpointPort) {
+	for _, port := range ports {
+		service, err := c.createConsulService(endpoint, annotations, address, port, ports)
+		if err != nil {
+			glog.V(2).Infof("Can't convert endpoint to Consul's service: %s", err)
+			continue
+		}
+
+		if !consul.IsServiceChanged(registeredServices[service.ID], service) {
+			continue
+		}
+
+		pod, err := c.getPod(address.TargetRef.Namespace, address.TargetRef.Name)
+		if err != nil {
+			glog.Errorf("Can't get pod %s: %s", address.TargetRef.Name, err)
+			return
+		}
+
+		glog.Infof("Service %s has changed, updating service in consul", service.ID)
+		consulAgent := c.consulInstance.New(c.cfg, pod.Spec.NodeName, pod.Status.PodIP)
+		err = consulAgent.Register(service)
+		if err != nil {
+			glog.Errorf("Can't update service: %s", err)
+			metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+		} else {
+			registeredServices[service.ID] = service
+			metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+		}
+	}
+}
+
 func (c *Controller) getPod(namespace string, podName string) (*v1.Pod, error) {
 	pod, err := c.clientset.CoreV1().Pods(namespace).Get(podName)
 	if err != nil {
@@ -393,23 +653,175 @@ func (c *Controller) getPod(namespace string, podName string) (*v1.Pod, error) {
 	return pod, nil
 }
 
-func (c *Controller) createConsulService(endpoint *v1.Endpoints, address v1.EndpointAddress, port v1.EndpointPort) (*consulapi.AgentServiceRegistration, error) {
+// getAnnotations returns annotations of Endpoints merged with annotations of
+// Service which owns the Endpoints, Service is taken from the store of Services.
+func (c *Controller) getAnnotations(endpoint *v1.Endpoints) map[string]string {
+	var service *v1.Service
+
+	key := fmt.Sprintf("%s/%s", endpoint.ObjectMeta.Namespace, endpoint.ObjectMeta.Name)
+	obj, exists, err := c.services.GetByKey(key)
+	if err != nil {
+		glog.V(2).Infof("Can't get service %s: %s", key, err)
+	} else if exists {
+		service = obj.(*v1.Service)
+	}
+
+	return mergeAnnotations(endpoint, service)
+}
+
+// mergeAnnotations returns annotations of Endpoints merged with annotations of
+// Service which owns the Endpoints. Annotations of Service take precedence.
+func mergeAnnotations(endpoint *v1.Endpoints, service *v1.Service) map[string]string {
+	var annotations = make(map[string]string)
+
+	for k, v := range endpoint.ObjectMeta.Annotations {
+		annotations[k] = v
+	}
+	if service != nil {
+		for k, v := range service.ObjectMeta.Annotations {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+// createConsulService converts port of endpoint address into Consul service, ports are all ports of the subset
+func (c *Controller) createConsulService(endpoint *v1.Endpoints, annotations map[string]string, address v1.EndpointAddress, port v1.EndpointPort, ports []v1.EndpointPort) (*consulapi.AgentServiceRegistration, error) {
 	service := &consulapi.AgentServiceRegistration{}
 
-	service.ID = fmt.Sprintf("%s-%d", address.TargetRef.Name, port.Port)
-	service.Name = endpoint.ObjectMeta.Name
+	protocol := port.Protocol
+	if protocol == "" {
+		protocol = v1.ProtocolTCP
+	}
+
+	service.ID = getServiceID(address.TargetRef.Name, port, ports)
+	service.Name = getServiceName(endpoint, annotations, port)
+	service.Namespace = consul.Namespace(c.cfg, endpoint.ObjectMeta.Namespace)
 
 	//Add K8sTag from configuration
 	service.Tags = []string{c.cfg.Controller.K8sTag}
 	service.Tags = append(service.Tags, fmt.Sprintf("uid:%s", address.TargetRef.UID))
 	service.Tags = append(service.Tags, labelsToTags(endpoint.ObjectMeta.Labels)...)
+	service.Tags = append(service.Tags, annotationsToTags(annotations)...)
+	if port.Name != "" {
+		service.Tags = append(service.Tags, fmt.Sprintf("port:%s", port.Name))
+	}
+	service.Tags = append(service.Tags, fmt.Sprintf("protocol:%s", strings.ToLower(string(protocol))))
+	service.Meta = annotationsToMeta(annotations)
+	service.Meta["protocol"] = strings.ToLower(string(protocol))
+	consul.SetOwner(c.cfg, service)
+
+	if value, ok := annotations[ConsulRegisterServiceWeightAnnotation]; ok {
+		weights, err := utils.ParseWeights(value)
+		if err != nil {
+			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterServiceWeightAnnotation, err)
+		} else {
+			service.Weights = weights
+		}
+	}
 
 	service.Port = int(port.Port)
 	service.Address = address.IP
 
+	check, err := annotationsToCheck(annotations, address.IP, port.Port)
+	if err != nil {
+		return service, err
+	}
+	// Checks of both types need TCP connection
+	if check != nil && protocol != v1.ProtocolTCP {
+		glog.V(2).Infof("Port %d has protocol %s, check is omitted", port.Port, protocol)
+		check = nil
+	}
+	if check != nil {
+		service.Checks = append(service.Checks, check)
+	}
+
 	return service, nil
 }
 
+// getServiceID returns ID of Consul service for the pod and port, ports are all ports of the subset.
+// The protocol is added as suffix according to utils.ProtocolSuffix.
+func getServiceID(podName string, port v1.EndpointPort, ports []v1.EndpointPort) string {
+	var tcpPorts = make(map[int32]bool)
+	for _, other := range ports {
+		if other.Protocol == "" || other.Protocol == v1.ProtocolTCP {
+			tcpPorts[other.Port] = true
+		}
+	}
+	return fmt.Sprintf("%s-%d%s", podName, port.Port, utils.ProtocolSuffix(port.Port, port.Protocol, tcpPorts))
+}
+
+// getServiceName returns the name of Consul service. The name which is mapped to the named port
+// takes precedence over `service.name` annotation. If none of them is set then name of Endpoints is used.
+func getServiceName(endpoint *v1.Endpoints, annotations map[string]string, port v1.EndpointPort) string {
+	if port.Name != "" {
+		if value, ok := annotations[ConsulRegisterServicePortPrefixAnnotation+port.Name]; ok && value != "" {
+			return value
+		}
+	}
+
+	if value, ok := annotations[ConsulRegisterServiceNameAnnotation]; ok && value != "" {
+		return value
+	}
+	return endpoint.ObjectMeta.Name
+}
+
+func annotationsToTags(annotations map[string]string) []string {
+	var tags []string
+
+	if value, ok := annotations[ConsulRegisterServiceTagsAnnotation]; ok {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func annotationsToMeta(annotations map[string]string) map[string]string {
+	meta := make(map[string]string)
+	for key, value := range annotations {
+		if strings.HasPrefix(key, ConsulRegisterServiceMetaPrefixAnnotation) {
+			meta[strings.TrimPrefix(key, ConsulRegisterServiceMetaPrefixAnnotation)] = value
+		}
+	}
+	return meta
+}
+
+// annotationsToCheck converts `service.check.*` annotations into Consul check.
+// It returns nil if `service.check.type` annotation is not set.
+func annotationsToCheck(annotations map[string]string, address string, port int32) (*consulapi.AgentServiceCheck, error) {
+	checkType, ok := annotations[ConsulRegisterServiceCheckTypeAnnotation]
+	if !ok || checkType == "" {
+		return nil, nil
+	}
+
+	check := &consulapi.AgentServiceCheck{
+		Status:   "passing",
+		Interval: "10s",
+		Timeout:  "2s",
+	}
+	if value, ok := annotations[ConsulRegisterServiceCheckIntervalAnnotation]; ok && value != "" {
+		check.Interval = value
+	}
+	if value, ok := annotations[ConsulRegisterServiceCheckTimeoutAnnotation]; ok && value != "" {
+		check.Timeout = value
+	}
+
+	switch checkType {
+	case "http", "https":
+		check.Name = "HTTP Check"
+		check.HTTP = fmt.Sprintf("%s://%s:%d%s", checkType, address, port, annotations[ConsulRegisterServiceCheckPathAnnotation])
+	case "tcp":
+		check.Name = "TCP Check"
+		check.TCP = fmt.Sprintf("%s:%d", address, port)
+	default:
+		return nil, fmt.Errorf("Wrong value of %s annotation. Permitted values: http|https|tcp, is %s",
+			ConsulRegisterServiceCheckTypeAnnotation, checkType)
+	}
+	return check, nil
+}
 func labelsToTags(labels map[string]string) []string {
 	var tags []string
 
@@ -425,8 +837,8 @@ func labelsToTags(labels map[string]string) []string {
 
 }
 
-func isRegisterEnabled(obj interface{}) bool {
-	if value, ok := obj.(*v1.Endpoints).ObjectMeta.Annotations[ConsulRegisterEnabledAnnotation]; ok {
+func isRegisterEnabled(endpoint *v1.Endpoints, annotations map[string]string) bool {
+	if value, ok := annotations[ConsulRegisterEnabledAnnotation]; ok {
 		enabled, err := strconv.ParseBool(value)
 		if err != nil {
 			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterEnabledAnnotation, err)
@@ -434,11 +846,11 @@ func isRegisterEnabled(obj interface{}) bool {
 		}
 
 		if !enabled {
-			glog.Infof("Endpoint %s in %s namespace is disabled by annotation. Value: %s", obj.(*v1.Endpoints).ObjectMeta.Name, obj.(*v1.Endpoints).ObjectMeta.Namespace, value)
+			glog.Infof("Endpoint %s in %s namespace is disabled by annotation. Value: %s", endpoint.ObjectMeta.Name, endpoint.ObjectMeta.Namespace, value)
 			return false
 		}
 	} else {
-		glog.V(1).Infof("Endpoint %s in %s namespace will not be registered in Consul. Lack of annotation %s", obj.(*v1.Endpoints).ObjectMeta.Name, obj.(*v1.Endpoints).ObjectMeta.Namespace, ConsulRegisterEnabledAnnotation)
+		glog.V(1).Infof("Endpoint %s in %s namespace will not be registered in Consul. Lack of annotation %s", endpoint.ObjectMeta.Name, endpoint.ObjectMeta.Namespace, ConsulRegisterEnabledAnnotation)
 		return false
 	}
 	return true
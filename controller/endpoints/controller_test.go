@@ -0,0 +1,263 @@
+package endpoints
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/consul"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetServiceID(t *testing.T) {
+	t.Parallel()
+
+	tcp := v1.EndpointPort{Port: 53, Protocol: v1.ProtocolTCP}
+	udp := v1.EndpointPort{Port: 53, Protocol: v1.ProtocolUDP}
+	sctp := v1.EndpointPort{Port: 9000, Protocol: "SCTP"}
+
+	tests := []struct {
+		name     string
+		port     v1.EndpointPort
+		ports    []v1.EndpointPort
+		expected string
+	}{
+		{"tcp", tcp, []v1.EndpointPort{tcp, udp}, "pod-53"},
+		{"default protocol", v1.EndpointPort{Port: 80}, []v1.EndpointPort{{Port: 80}}, "pod-80"},
+		{"udp with tcp on the same port", udp, []v1.EndpointPort{tcp, udp}, "pod-53-udp"},
+		// Services registered before support of protocols keep their IDs
+		{"udp only", udp, []v1.EndpointPort{udp}, "pod-53"},
+		{"sctp with tcp on other port", sctp, []v1.EndpointPort{tcp, sctp}, "pod-9000"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, getServiceID("pod", test.port, test.ports), test.name)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag: "kubernetes",
+		},
+	}
+
+	newEndpoints := func(annotations map[string]string, targetRef *v1.ObjectReference) *v1.Endpoints {
+		return &v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", Annotations: annotations},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", TargetRef: targetRef}},
+				Ports: []v1.EndpointPort{
+					{Name: "http", Port: 80, Protocol: v1.ProtocolTCP},
+					{Name: "dns", Port: 53, Protocol: v1.ProtocolUDP},
+				},
+			}},
+		}
+	}
+	pod := &v1.ObjectReference{Kind: "Pod", Name: "nginx-1", UID: "uid-1"}
+	enabled := map[string]string{ConsulRegisterEnabledAnnotation: "true"}
+
+	tests := []struct {
+		name     string
+		endpoint *v1.Endpoints
+		service  *v1.Service
+		ids      []string
+		names    []string
+		err      bool
+	}{
+		{
+			name:     "enabled endpoints",
+			endpoint: newEndpoints(enabled, pod),
+			ids:      []string{"nginx-1-80", "nginx-1-53"},
+			names:    []string{"nginx", "nginx"},
+		},
+		{
+			name:     "disabled endpoints",
+			endpoint: newEndpoints(nil, pod),
+		},
+		{
+			name:     "enabled by service",
+			endpoint: newEndpoints(nil, pod),
+			service: &v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+				ConsulRegisterEnabledAnnotation:                    "true",
+				ConsulRegisterServicePortPrefixAnnotation + "http": "web",
+			}}},
+			ids:   []string{"nginx-1-80", "nginx-1-53"},
+			names: []string{"web", "nginx"},
+		},
+		{
+			name:     "disabled by service",
+			endpoint: newEndpoints(enabled, pod),
+			service: &v1.Service{ObjectMeta: v1.ObjectMeta{Annotations: map[string]string{
+				ConsulRegisterEnabledAnnotation: "false",
+			}}},
+		},
+		{
+			name:     "address without target reference",
+			endpoint: newEndpoints(enabled, nil),
+			err:      true,
+		},
+	}
+
+	for _, test := range tests {
+		services, err := Simulate(test.endpoint, test.service, cfg)
+		if test.err {
+			assert.Error(t, err, test.name)
+			continue
+		}
+		assert.NoError(t, err, test.name)
+
+		var ids, names []string
+		for _, service := range services {
+			ids = append(ids, service.ID)
+			names = append(names, service.Name)
+			assert.Equal(t, "10.0.0.1", service.Address, test.name)
+			assert.Contains(t, service.Tags, "uid:uid-1", test.name)
+		}
+		assert.Equal(t, test.ids, ids, test.name)
+		assert.Equal(t, test.names, names, test.name)
+	}
+}
+
+func TestGetRemovedServiceIDs(t *testing.T) {
+	t.Parallel()
+
+	pod1 := v1.EndpointAddress{IP: "10.0.0.1", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-1", UID: "uid-1"}}
+	pod2 := v1.EndpointAddress{IP: "10.0.0.2", TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "pod-2", UID: "uid-2"}}
+	httpPort := v1.EndpointPort{Port: 80, Protocol: v1.ProtocolTCP}
+	httpsPort := v1.EndpointPort{Port: 443, Protocol: v1.ProtocolTCP}
+	dnsTCP := v1.EndpointPort{Port: 53, Protocol: v1.ProtocolTCP}
+	dnsUDP := v1.EndpointPort{Port: 53, Protocol: v1.ProtocolUDP}
+	newEndpoints := func(addresses []v1.EndpointAddress, ports ...v1.EndpointPort) *v1.Endpoints {
+		return &v1.Endpoints{Subsets: []v1.EndpointSubset{{Addresses: addresses, Ports: ports}}}
+	}
+
+	tests := []struct {
+		name     string
+		old      *v1.Endpoints
+		new      *v1.Endpoints
+		expected []string
+	}{
+		{
+			name: "unchanged",
+			old:  newEndpoints([]v1.EndpointAddress{pod1}, httpPort, httpsPort),
+			new:  newEndpoints([]v1.EndpointAddress{pod1}, httpPort, httpsPort),
+		},
+		{
+			name:     "removed port",
+			old:      newEndpoints([]v1.EndpointAddress{pod1, pod2}, httpPort, httpsPort),
+			new:      newEndpoints([]v1.EndpointAddress{pod1, pod2}, httpPort),
+			expected: []string{"pod-1-443", "pod-2-443"},
+		},
+		{
+			name:     "changed port",
+			old:      newEndpoints([]v1.EndpointAddress{pod1}, httpPort),
+			new:      newEndpoints([]v1.EndpointAddress{pod1}, v1.EndpointPort{Port: 8080, Protocol: v1.ProtocolTCP}),
+			expected: []string{"pod-1-80"},
+		},
+		{
+			// Services of removed address are deregistered together with the address
+			name:     "removed address",
+			old:      newEndpoints([]v1.EndpointAddress{pod1, pod2}, httpPort, httpsPort),
+			new:      newEndpoints([]v1.EndpointAddress{pod1}, httpPort),
+			expected: []string{"pod-1-443"},
+		},
+		{
+			name: "added port",
+			old:  newEndpoints([]v1.EndpointAddress{pod1}, httpPort),
+			new:  newEndpoints([]v1.EndpointAddress{pod1}, httpPort, httpsPort),
+		},
+		{
+			// UDP port gets ID without suffix once TCP port with the same number is removed
+			name:     "removed tcp counterpart",
+			old:      newEndpoints([]v1.EndpointAddress{pod1}, dnsTCP, dnsUDP),
+			new:      newEndpoints([]v1.EndpointAddress{pod1}, dnsUDP),
+			expected: []string{"pod-1-53-udp"},
+		},
+	}
+
+	for _, test := range tests {
+		var removed []string
+		for serviceID, address := range getRemovedServiceIDs(test.old, test.new) {
+			removed = append(removed, serviceID)
+			assert.True(t, strings.HasPrefix(serviceID, address.TargetRef.Name), test.name)
+		}
+		sort.Strings(removed)
+		assert.Equal(t, test.expected, removed, test.name)
+	}
+}
+
+func TestEventUpdateFuncRemovedPort(t *testing.T) {
+	var mutex sync.Mutex
+	var deregistered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/") {
+			mutex.Lock()
+			deregistered = append(deregistered, strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/"))
+			mutex.Unlock()
+		}
+	}))
+	defer server.Close()
+	address, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	addedEndpoints = map[types.UID]bool{"uid-1": true}
+	registeredServices = make(map[string]*consulapi.AgentServiceRegistration)
+
+	pod := &v1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: "pod-1", Namespace: "default"},
+		Spec:       v1.PodSpec{NodeName: "node-1"},
+		Status:     v1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	c := &Controller{
+		clientset:      fake.NewSimpleClientset(pod),
+		consulInstance: consul.Adapter{},
+		cfg: &config.Config{
+			Controller: &config.ControllerConfig{
+				K8sTag:        "kubernetes",
+				ConsulAddress: address.Hostname(),
+				ConsulPort:    address.Port(),
+				ConsulScheme:  "http",
+				RegisterMode:  config.RegisterSingleMode,
+			},
+			Consul: consulapi.DefaultConfig(),
+		},
+		mutex:    &sync.Mutex{},
+		services: cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+
+	newEndpoints := func(ports ...v1.EndpointPort) *v1.Endpoints {
+		return &v1.Endpoints{
+			ObjectMeta: v1.ObjectMeta{
+				Name:        "nginx",
+				Namespace:   "default",
+				Annotations: map[string]string{ConsulRegisterEnabledAnnotation: "true"},
+			},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{
+					IP:        "10.0.0.1",
+					TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "pod-1", UID: "uid-1"},
+				}},
+				Ports: ports,
+			}},
+		}
+	}
+	httpPort := v1.EndpointPort{Port: 80, Protocol: v1.ProtocolTCP}
+	httpsPort := v1.EndpointPort{Port: 443, Protocol: v1.ProtocolTCP}
+
+	assert.NoError(t, c.eventUpdateFunc(newEndpoints(httpPort, httpsPort), newEndpoints(httpPort)))
+	assert.Equal(t, []string{"pod-1-443"}, deregistered, "service of removed port should be deregistered")
+	assert.Contains(t, registeredServices, "pod-1-80")
+}
@@ -0,0 +1,41 @@
+package endpoints
+
+import (
+	"fmt"
+
+	"github.com/tczekajlo/kube-consul-register/config"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Simulate returns Consul services which would be registered for given Endpoints, without access to
+// Kubernetes and Consul. Annotations of Service which owns the Endpoints are taken into account if given.
+func Simulate(endpoint *v1.Endpoints, service *v1.Service, cfg *config.Config) ([]*consulapi.AgentServiceRegistration, error) {
+	var services []*consulapi.AgentServiceRegistration
+
+	c := &Controller{cfg: cfg}
+
+	annotations := mergeAnnotations(endpoint, service)
+
+	if !isRegisterEnabled(endpoint, annotations) {
+		return nil, nil
+	}
+
+	for _, subset := range endpoint.Subsets {
+		for _, address := range subset.Addresses {
+			if address.TargetRef == nil {
+				return services, fmt.Errorf("Address %s of endpoints %s has no target reference", address.IP, endpoint.ObjectMeta.Name)
+			}
+			for _, port := range subset.Ports {
+				consulService, err := c.createConsulService(endpoint, annotations, address, port, subset.Ports)
+				if err != nil {
+					return services, fmt.Errorf("Can't convert endpoint to Consul's service: %s", err)
+				}
+				services = append(services, consulService)
+			}
+		}
+	}
+	return services, nil
+}
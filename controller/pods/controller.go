@@ -28,24 +28,41 @@ import (
 // "ConsulRegisterEnabledAnnotation" is a name of annotation key for `enabled` option.
 // "ConsulRegisterServiceNameAnnotation" is a name of annotation key for `service.name` option.
 // "ConsulRegisterServiceMetaPrefixAnnotation" is a prefix name of annotation key for `service.meta` option.
+// "ConsulRegisterServiceWeightAnnotation" is a name of annotation key for `service.weight` option,
+// weights of service in format `<passing>[,<warning>]`.
 // "CreatedByAnnotation" represents the key used to store the spec(json)
 // used to create the resource
 // "ExpectedContainerNamesAnnotation" is a name of container or list of names (separated by comma)
 // which are take into account during register process.
+// "ConsulRegisterConnectEnabledAnnotation" is a name of annotation key for `connect.enabled` option.
+// "ConsulRegisterConnectNativeAnnotation" is a name of annotation key for `connect.native` option.
+// "ConsulRegisterConnectSidecarPortAnnotation" is a name of annotation key for `connect.sidecar.port` option.
+// "ConsulRegisterConnectUpstreamsAnnotation" is a name of annotation key for `connect.upstreams` option,
+// list of upstreams (separated by comma) in format `name:port[:datacenter]`.
 const (
-	ConsulRegisterEnabledAnnotation           string = "consul.register/enabled"
-	ConsulRegisterServiceNameAnnotation       string = "consul.register/service.name"
-	ConsulRegisterServiceMetaPrefixAnnotation string = "consul.register/service.meta."
-	CreatedByAnnotation                       string = "kubernetes.io/created-by"
-	ExpectedContainerNamesAnnotation          string = "consul.register/pod.container.name"
-  ContainerProbeLivenessAnnotation          string = "consul.register/pod.container.probe.liveness"
-	ContainerProbeReadinessAnnotation         string = "consul.register/pod.container.probe.readiness"
+	ConsulRegisterEnabledAnnotation            string = "consul.register/enabled"
+	ConsulRegisterServiceNameAnnotation        string = "consul.register/service.name"
+	ConsulRegisterServiceMetaPrefixAnnotation  string = "consul.register/service.meta."
+	ConsulRegisterServiceWeightAnnotation      string = "consul.register/service.weight"
+	CreatedByAnnotation                        string = "kubernetes.io/created-by"
+	ExpectedContainerNamesAnnotation           string = "consul.register/pod.container.name"
+	ContainerProbeLivenessAnnotation           string = "consul.register/pod.container.probe.liveness"
+	ContainerProbeReadinessAnnotation          string = "consul.register/pod.container.probe.readiness"
+	ConsulRegisterConnectEnabledAnnotation     string = "consul.register/connect.enabled"
+	ConsulRegisterConnectNativeAnnotation      string = "consul.register/connect.native"
+	ConsulRegisterConnectSidecarPortAnnotation string = "consul.register/connect.sidecar.port"
+	ConsulRegisterConnectUpstreamsAnnotation   string = "consul.register/connect.upstreams"
 )
 
 var (
 	addedPods       = make(map[types.UID]bool)
 	addedContainers = make(map[string]bool)
-	addedServices   = make(map[string]bool)
+	// orphans counts consecutive runs of cleaning in which services are missing in Kubernetes,
+	// nodeOrphans counts runs in which synthetic nodes of `catalog` mode are inactive
+	orphans     = make(utils.Orphans)
+	nodeOrphans = make(utils.Orphans)
+	// registeredServices keeps the last registered services, service is updated in place when it changes
+	registeredServices = make(map[string]*consulapi.AgentServiceRegistration)
 
 	consulAgents map[string]*consul.Adapter
 )
@@ -88,8 +105,7 @@ func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
 		}
 
 		for _, node := range nodes.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+			consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
 			consulAgents[node.ObjectMeta.Name] = consulAgent
 		}
 	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
@@ -100,10 +116,24 @@ func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
 			return consulAgents, err
 		}
 		for _, pod := range pods.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			consulAgent := c.consulInstance.New(c.cfg, pod.Spec.NodeName, pod.Status.HostIP)
 			consulAgents[pod.Status.HostIP] = consulAgent
 		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Node for services which are not bound to Kubernetes node, or for all services in `cluster` mode
+		consulAgents[c.cfg.Controller.CatalogNodeName] = c.consulInstance.New(c.cfg, "", "")
+
+		if c.cfg.Controller.CatalogNodeMode == config.CatalogNodePerNode {
+			nodes, err := c.clientset.CoreV1().Nodes().List(v1.ListOptions{})
+			if err != nil {
+				return consulAgents, err
+			}
+
+			for _, node := range nodes.Items {
+				consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+				consulAgents[node.ObjectMeta.Name] = consulAgent
+			}
+		}
 	}
 
 	return consulAgents, nil
@@ -126,12 +156,14 @@ func (c *Controller) Clean() error {
 	}
 
 	// Get list of added Consul' services
-	addedConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, _, err := c.getAddedConsulServices()
 	if err != nil {
 		c.mutex.Unlock()
 		return err
 	}
 
+	var addedServices = make(map[string]bool)
+
 	// Make list of Kubernetes PODs
 	pods, err := c.clientset.CoreV1().Pods(c.namespace).List(v1.ListOptions{
 		LabelSelector: c.cfg.Controller.PodLabelSelector,
@@ -153,6 +185,9 @@ func (c *Controller) Clean() error {
 		for _, container := range podInfo.ContainerStatuses {
 			serviceID := fmt.Sprintf("%s-%s", podInfo.Name, container.Name)
 			addedServices[serviceID] = true
+			if podInfo.hasConnectSidecar() {
+				addedServices[consul.SidecarServiceID(serviceID)] = true
+			}
 		}
 
 		podsInCluster = append(podsInCluster, podInfo) // nolint: megacheck
@@ -160,19 +195,33 @@ func (c *Controller) Clean() error {
 	//Deletion of inactive services
 	//Delete all services which doesn't exists in Consul
 	//If service doesn't exists in addedService map then delete them
-	for serviceID, consulAgentID := range addedConsulServices {
+	var missing []string
+	for serviceID := range addedConsulServices {
 		if _, ok := addedServices[serviceID]; !ok {
-			service := &consulapi.AgentServiceRegistration{ID: serviceID}
-			err := consulAgents[consulAgentID].Deregister(service)
-			if err != nil {
-				glog.Errorf("Can't deregister service: %s", err)
-				continue
-			}
-			glog.Infof("Service's been deregistered, ID: %s", service.ID)
-			glog.V(2).Infof("%#v", service)
-			delete(addedConsulServices, service.ID)
+			missing = append(missing, serviceID)
 		}
 	}
+	orphaned, held := consul.OrphanedServices(c.cfg, "pod", orphans, missing, len(addedConsulServices))
+	for _, serviceID := range held {
+		consulAgents[addedConsulServices[serviceID]].Hold("", &consulapi.AgentServiceRegistration{ID: serviceID})
+	}
+	for _, serviceID := range orphaned {
+		service := &consulapi.AgentServiceRegistration{ID: serviceID}
+		err := consulAgents[addedConsulServices[serviceID]].Deregister(service)
+		if err != nil {
+			glog.Errorf("Can't deregister service: %s", err)
+			continue
+		}
+		glog.Infof("Service's been deregistered, ID: %s", service.ID)
+		glog.V(2).Infof("%#v", service)
+		delete(addedConsulServices, service.ID)
+		delete(registeredServices, service.ID)
+	}
+
+	if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		c.consulInstance.CleanInactiveNodes(c.cfg, nodeOrphans, consulAgents)
+	}
+
 	c.mutex.Unlock()
 	return nil
 }
@@ -193,13 +242,16 @@ func (c *Controller) Sync() error {
 	glog.V(2).Infof("Agents: %#v", consulAgents)
 
 	// Get list of added Consul' services
-	addedConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, consulServices, err := c.getAddedConsulServices()
 	if err != nil {
 		c.mutex.Unlock()
 		return err
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
+	// Get checks of services from Consul' Agents
+	consulChecks := c.getConsulChecks()
+
 	pods, err := c.clientset.CoreV1().Pods(c.namespace).List(v1.ListOptions{
 		LabelSelector: c.cfg.Controller.PodLabelSelector,
 	})
@@ -226,6 +278,9 @@ func (c *Controller) Sync() error {
 				if err := eventUpdateFunc(&pod, c.consulInstance, c.cfg); err != nil {
 					glog.Errorf("Failed to sync pod: %s: %s", podInfo.Name, err)
 				}
+			} else if agentChecks, ok := consulChecks[addedConsulServices[serviceID]]; ok {
+				// If service differs from the one which POD implies then register it once again
+				c.repairDrift(podInfo, container, consulServices[serviceID], agentChecks[serviceID], consulAgents[addedConsulServices[serviceID]])
 			}
 		}
 	}
@@ -289,9 +344,58 @@ func (c *Controller) Watch() {
 	controller.Run(stop)
 }
 
+// repairDrift registers service of container once again if the service registered in Consul
+// differs from the one which POD implies
+func (c *Controller) repairDrift(podInfo *PodInfo, container v1.ContainerStatus, registered *consulapi.AgentService, checks []*consulapi.AgentCheck, consulAgent *consul.Adapter) {
+	service, err := podInfo.PodToConsulService(container, c.cfg)
+	if err != nil {
+		glog.V(2).Infof("Can't convert POD to Consul's service: %s", err)
+		return
+	}
+
+	fields := consul.ServiceDrift(service, registered, checks)
+	if len(fields) == 0 {
+		return
+	}
+
+	glog.Warningf("Service %s differs from POD %s (%s), registering service once again", service.ID, podInfo.Name, strings.Join(fields, ","))
+	err = consulAgent.Register(service)
+	if err != nil {
+		glog.Errorf("Can't register service: %s", err)
+		metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+		return
+	}
+	metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+	registeredServices[service.ID] = service
+	// In dry-run mode registration is only recorded, nothing is repaired
+	if c.cfg.Controller.DryRun {
+		return
+	}
+	for _, field := range fields {
+		metrics.DriftRepaired.WithLabelValues(field).Inc()
+	}
+}
+
+// getConsulChecks returns checks of Consul services grouped by Consul Agent and ID of service.
+// Consul Agents which checks can't be taken from are omitted.
+func (c *Controller) getConsulChecks() map[string]map[string][]*consulapi.AgentCheck {
+	var checks = make(map[string]map[string][]*consulapi.AgentCheck)
+
+	for consulAgentID, consulAgent := range consulAgents {
+		agentChecks, err := consulAgent.ServiceChecks()
+		if err != nil {
+			glog.Errorf("Can't get checks from Consul Agent %s: %s", consulAgentID, err)
+			continue
+		}
+		checks[consulAgentID] = agentChecks
+	}
+	return checks
+}
+
 // getAddedConsulServices returns the list of added Consul Services
-func (c *Controller) getAddedConsulServices() (map[string]string, error) {
+func (c *Controller) getAddedConsulServices() (map[string]string, map[string]*consulapi.AgentService, error) {
 	var addedServices = make(map[string]string)
+	var consulServices = make(map[string]*consulapi.AgentService)
 
 	// Make list of Consul's services
 	for consulAgentID, consulAgent := range consulAgents {
@@ -301,13 +405,14 @@ func (c *Controller) getAddedConsulServices() (map[string]string, error) {
 		} else {
 			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
 			for _, service := range services {
-				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) {
+				if consul.IsOwned(c.cfg, service.Tags, service.Meta) {
 					addedServices[service.ID] = consulAgentID
+					consulServices[service.ID] = service
 				}
 			}
 		}
 	}
-	return addedServices, nil
+	return addedServices, consulServices, nil
 }
 
 func eventDeleteFunc(obj interface{}, consulInstance consul.Adapter, cfg *config.Config) error {
@@ -329,7 +434,10 @@ func eventDeleteFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 		// Consul Agent
 		consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
 		serviceID := fmt.Sprintf("%s-%s", podInfo.Name, container.Name)
-		service := &consulapi.AgentServiceRegistration{ID: serviceID}
+		service := &consulapi.AgentServiceRegistration{
+			ID:        serviceID,
+			Namespace: consul.Namespace(cfg, podInfo.Namespace),
+		}
 		err := consulAgent.Deregister(service)
 		if err != nil {
 			glog.Errorf("Can't deregister service: %s", err)
@@ -341,6 +449,7 @@ func eventDeleteFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 		}
 
 		delete(addedContainers, container.ContainerID)
+		delete(registeredServices, serviceID)
 	}
 
 	metrics.PodSuccess.WithLabelValues("delete").Inc()
@@ -395,6 +504,7 @@ func eventUpdateFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 					glog.Infof("Service's been registered, Name: %s, ID: %s", service.Name, service.ID)
 					glog.V(2).Infof("%#v", service)
 					addedContainers[container.ContainerID] = true
+					registeredServices[service.ID] = service
 					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
 				}
 			} else if _, ok := addedContainers[container.ContainerID]; ok && !container.Ready {
@@ -402,6 +512,8 @@ func eventUpdateFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 				glog.Warningf("Removing service for container %s in POD %s from consul", container.Name, podInfo.Name)
 
 				delete(addedContainers, container.ContainerID)
+			} else if _, ok := addedContainers[container.ContainerID]; ok {
+				updateService(podInfo, container, consulInstance, cfg)
 			}
 		}
 	} else if podInfo.Phase == v1.PodRunning && podInfo.Ready == v1.ConditionTrue {
@@ -421,6 +533,31 @@ func eventUpdateFunc(obj interface{}, consulInstance consul.Adapter, cfg *config
 	return nil
 }
 
+// updateService registers service of container once again if its registration has changed.
+// Consul Agent updates registered service in place.
+func updateService(podInfo *PodInfo, container v1.ContainerStatus, consulInstance consul.Adapter, cfg *config.Config) {
+	service, err := podInfo.PodToConsulService(container, cfg)
+	if err != nil {
+		glog.V(2).Infof("Can't convert POD to Consul's service: %s", err)
+		return
+	}
+
+	if !consul.IsServiceChanged(registeredServices[service.ID], service) {
+		return
+	}
+
+	glog.Infof("Service %s has changed, updating service in consul", service.ID)
+	consulAgent := consulInstance.New(cfg, podInfo.NodeName, podInfo.IP)
+	err = consulAgent.Register(service)
+	if err != nil {
+		glog.Errorf("Can't update service: %s", err)
+		metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+	} else {
+		registeredServices[service.ID] = service
+		metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+	}
+}
+
 // PodToConsulService converts POD data to Consul service structure
 func (p *PodInfo) PodToConsulService(containerStatus v1.ContainerStatus, cfg *config.Config) (*consulapi.AgentServiceRegistration, error) {
 	service := &consulapi.AgentServiceRegistration{}
@@ -437,11 +574,22 @@ func (p *PodInfo) PodToConsulService(containerStatus v1.ContainerStatus, cfg *co
 	}
 
 	service.ID = fmt.Sprintf("%s-%s", p.Name, containerStatus.Name)
+	service.Namespace = consul.Namespace(cfg, p.Namespace)
 	service.Tags = p.labelsToTags(containerStatus.Name)
 	service.Meta = p.annotationsToMeta()
 
+	if value, ok := p.Annotations[ConsulRegisterServiceWeightAnnotation]; ok {
+		weights, err := utils.ParseWeights(value)
+		if err != nil {
+			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterServiceWeightAnnotation, err)
+		} else {
+			service.Weights = weights
+		}
+	}
+
 	//Add K8sTag from configuration
 	service.Tags = append(service.Tags, cfg.Controller.K8sTag)
+	consul.SetOwner(cfg, service)
 
 	port := p.getContainerPort(containerStatus.Name)
 	if port == 0 {
@@ -457,9 +605,81 @@ func (p *PodInfo) PodToConsulService(containerStatus v1.ContainerStatus, cfg *co
 		service.Checks = append(service.Checks, p.probeToConsulCheck(p.getContainerReadinessProbe(containerStatus.Name), "Readiness Probe"))
 	}
 
+	connect, err := p.annotationsToConnect(service)
+	if err != nil {
+		return service, err
+	}
+	service.Connect = connect
+
 	return service, nil
 }
 
+// annotationsToConnect returns Consul Connect configuration of service. Sidecar proxy
+// is registered together with service, unless service is Connect native.
+func (p *PodInfo) annotationsToConnect(service *consulapi.AgentServiceRegistration) (*consulapi.AgentServiceConnect, error) {
+	if !p.isAnnotationEnabled(ConsulRegisterConnectEnabledAnnotation) {
+		return nil, nil
+	}
+
+	if p.isAnnotationEnabled(ConsulRegisterConnectNativeAnnotation) {
+		return &consulapi.AgentServiceConnect{Native: true}, nil
+	}
+
+	// Port of sidecar is allocated by Consul Agent if not set
+	sidecar := &consulapi.AgentServiceRegistration{
+		Address: service.Address,
+		Proxy:   &consulapi.AgentServiceConnectProxyConfig{},
+	}
+	if value, ok := p.Annotations[ConsulRegisterConnectSidecarPortAnnotation]; ok {
+		port, err := strconv.Atoi(value)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("Wrong value of %s annotation: %s", ConsulRegisterConnectSidecarPortAnnotation, value)
+		}
+		sidecar.Port = port
+	}
+
+	if value, ok := p.Annotations[ConsulRegisterConnectUpstreamsAnnotation]; ok && value != "" {
+		for _, upstream := range strings.Split(value, ",") {
+			parts := strings.Split(strings.TrimSpace(upstream), ":")
+			if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+				return nil, fmt.Errorf("Wrong upstream in %s annotation: %s", ConsulRegisterConnectUpstreamsAnnotation, upstream)
+			}
+			port, err := strconv.Atoi(parts[1])
+			if err != nil || port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("Wrong port of upstream in %s annotation: %s", ConsulRegisterConnectUpstreamsAnnotation, upstream)
+			}
+
+			u := consulapi.Upstream{
+				DestinationName: parts[0],
+				LocalBindPort:   port,
+			}
+			if len(parts) == 3 {
+				u.Datacenter = parts[2]
+			}
+			sidecar.Proxy.Upstreams = append(sidecar.Proxy.Upstreams, u)
+		}
+	}
+
+	return &consulapi.AgentServiceConnect{SidecarService: sidecar}, nil
+}
+
+// hasConnectSidecar checks if sidecar proxy is registered together with services of pod
+func (p *PodInfo) hasConnectSidecar() bool {
+	return p.isAnnotationEnabled(ConsulRegisterConnectEnabledAnnotation) && !p.isAnnotationEnabled(ConsulRegisterConnectNativeAnnotation)
+}
+
+func (p *PodInfo) isAnnotationEnabled(annotation string) bool {
+	if value, ok := p.Annotations[annotation]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			glog.Errorf("Can't convert value of %s annotation: %s", annotation, err)
+			return false
+		}
+		return enabled
+	}
+	return false
+}
+
 func (p *PodInfo) isRegisterEnabled() bool {
 	if value, ok := p.Annotations[ConsulRegisterEnabledAnnotation]; ok {
 		enabled, err := strconv.ParseBool(value)
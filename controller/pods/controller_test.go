@@ -4,8 +4,11 @@ import (
 	"testing"
 
 	consulapi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/consul"
+	"github.com/tczekajlo/kube-consul-register/metrics"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/util/intstr"
 )
@@ -70,6 +73,78 @@ func TestPodInfoMethods(t *testing.T) {
 	assert.Equal(t, true, isEnabledByAnnotation)
 }
 
+func TestAnnotationsToConnect(t *testing.T) {
+	t.Parallel()
+
+	service := &consulapi.AgentServiceRegistration{Address: "192.168.8.8", Port: 8080}
+	podInfo := &PodInfo{Annotations: map[string]string{}}
+
+	connect, err := podInfo.annotationsToConnect(service)
+	assert.NoError(t, err)
+	assert.Nil(t, connect)
+
+	podInfo.Annotations["consul.register/connect.enabled"] = "true"
+	podInfo.Annotations["consul.register/connect.sidecar.port"] = "21000"
+	podInfo.Annotations["consul.register/connect.upstreams"] = "db:5432, cache:6379:dc2"
+	connect, err = podInfo.annotationsToConnect(service)
+	assert.NoError(t, err)
+	assert.Equal(t, false, connect.Native)
+	assert.Equal(t, 21000, connect.SidecarService.Port)
+	assert.Equal(t, "192.168.8.8", connect.SidecarService.Address)
+	assert.Equal(t, []consulapi.Upstream{
+		{DestinationName: "db", LocalBindPort: 5432},
+		{DestinationName: "cache", LocalBindPort: 6379, Datacenter: "dc2"},
+	}, connect.SidecarService.Proxy.Upstreams)
+	assert.Equal(t, true, podInfo.hasConnectSidecar())
+
+	podInfo.Annotations["consul.register/connect.upstreams"] = "db"
+	_, err = podInfo.annotationsToConnect(service)
+	assert.Error(t, err, "An error was expected")
+
+	podInfo.Annotations["consul.register/connect.native"] = "true"
+	connect, err = podInfo.annotationsToConnect(service)
+	assert.NoError(t, err)
+	assert.Equal(t, true, connect.Native)
+	assert.Nil(t, connect.SidecarService)
+	assert.Equal(t, false, podInfo.hasConnectSidecar())
+}
+
+func TestSimulate(t *testing.T) {
+	t.Parallel()
+
+	objPod := &v1.Pod{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "podname",
+			Namespace:   "default",
+			Annotations: map[string]string{"consul.register/enabled": "true"},
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				{Name: "app", Ports: []v1.ContainerPort{{ContainerPort: 8080}}},
+				{Name: "consul"},
+			},
+		},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:              "kubernetes",
+			ConsulContainerName: "consul",
+		},
+	}
+
+	services, err := Simulate(objPod, cfg)
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, "podname-app", services[0].ID)
+	assert.Equal(t, 8080, services[0].Port)
+
+	objPod.ObjectMeta.Annotations["consul.register/enabled"] = "false"
+	services, err = Simulate(objPod, cfg)
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
 func TestProbeToConsulCheck(t *testing.T) {
 	t.Parallel()
 	emptyCheck := consulapi.AgentServiceCheck{}
@@ -113,3 +188,34 @@ func TestProbeToConsulCheck(t *testing.T) {
 	assert.Equal(t, emptyCheck, *noProbeCheck)
 	assert.Equal(t, emptyCheck, *execCheck)
 }
+
+func TestRepairDriftDryRun(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:              "kubernetes",
+			ConsulContainerName: "consul",
+			ConsulAddress:       "localhost",
+			ConsulPort:          "1",
+			ConsulScheme:        "http",
+			RegisterMode:        config.RegisterSingleMode,
+			DryRun:              true,
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+	c := &Controller{cfg: cfg}
+	consulInstance := consul.Adapter{}
+	consulAgent := consulInstance.New(cfg, "", "")
+
+	podInfo := &PodInfo{
+		Name:       "podname",
+		Namespace:  "default",
+		IP:         "10.0.0.1",
+		Containers: []v1.Container{{Name: "app", Ports: []v1.ContainerPort{{ContainerPort: 8080}}}},
+	}
+	registered := &consulapi.AgentService{ID: "podname-app", Service: "other"}
+
+	repaired := testutil.ToFloat64(metrics.DriftRepaired.WithLabelValues("name"))
+	c.repairDrift(podInfo, v1.ContainerStatus{Name: "app"}, registered, nil, consulAgent)
+	assert.Equal(t, repaired, testutil.ToFloat64(metrics.DriftRepaired.WithLabelValues("name")),
+		"drift recorded in dry-run mode shouldn't be counted as repaired")
+}
@@ -0,0 +1,44 @@
+package pods
+
+import (
+	"fmt"
+
+	"github.com/tczekajlo/kube-consul-register/config"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Simulate returns Consul services which would be registered for given POD, without access to
+// Kubernetes and Consul. If POD has no status then all containers from spec are taken into account.
+func Simulate(pod *v1.Pod, cfg *config.Config) ([]*consulapi.AgentServiceRegistration, error) {
+	var services []*consulapi.AgentServiceRegistration
+
+	podInfo := &PodInfo{}
+	podInfo.save(pod)
+
+	if !podInfo.isRegisterEnabled() {
+		return nil, nil
+	}
+
+	containerStatuses := podInfo.ContainerStatuses
+	if len(containerStatuses) == 0 {
+		for _, container := range podInfo.Containers {
+			containerStatuses = append(containerStatuses, v1.ContainerStatus{Name: container.Name})
+		}
+	}
+
+	for _, container := range containerStatuses {
+		if container.Name == cfg.Controller.ConsulContainerName || !podInfo.expectedContainerNames(container.Name) {
+			continue
+		}
+
+		service, err := podInfo.PodToConsulService(container, cfg)
+		if err != nil {
+			return services, fmt.Errorf("Can't convert container %s to Consul's service: %s", container.Name, err)
+		}
+		services = append(services, service)
+	}
+	return services, nil
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,6 +19,7 @@ import (
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
 	"k8s.io/client-go/pkg/fields"
+	"k8s.io/client-go/pkg/types"
 	"k8s.io/client-go/tools/cache"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -24,23 +27,53 @@ import (
 
 // These are valid annotations names which are take into account.
 // "ConsulRegisterEnabledAnnotation" is a name of annotation key for `enabled` option.
+// "ConsulRegisterClusterIPAnnotation" is a name of annotation key for `service.cluster_ip` option.
+// "ConsulRegisterServiceWeightAnnotation" is a name of annotation key for `service.weight` option,
+// weights of service in format `<passing>[,<warning>]`.
+// "ExternalTrafficAnnotation" is a name of annotation key which determines external traffic policy of service.
+// "TaintsAnnotation" is a name of annotation key which keeps taints of node.
 const (
-	ConsulRegisterEnabledAnnotation string = "consul.register/enabled"
+	ConsulRegisterEnabledAnnotation       string = "consul.register/enabled"
+	ConsulRegisterClusterIPAnnotation     string = "consul.register/service.cluster_ip"
+	ConsulRegisterServiceWeightAnnotation string = "consul.register/service.weight"
+	ExternalTrafficAnnotation             string = "service.beta.kubernetes.io/external-traffic"
+	TaintsAnnotation                      string = "scheduler.alpha.kubernetes.io/taints"
 )
 
+// protocolSCTP is the SCTP protocol.
+const protocolSCTP v1.Protocol = "SCTP"
+
+// taintEffectNoExecute is the effect of taint which evicts pods from node.
+const taintEffectNoExecute v1.TaintEffect = "NoExecute"
+
 var (
-	allAddedServices = make(map[string]bool)
+	// addedServices keeps Consul services registered for Kubernetes Services,
+	// UID:serviceConsulID:registration
+	addedServices = make(map[types.UID]map[string]*registration)
+	// unhealthyNodes keeps names of unhealthy nodes together with the reason
+	unhealthyNodes = make(map[string]string)
+	// orphans and externalOrphans count consecutive runs of cleaning in which services
+	// registered on Consul agents and on the external node are missing in Kubernetes,
+	// nodeOrphans counts runs in which synthetic nodes of `catalog` mode are inactive
+	orphans         = make(utils.Orphans)
+	externalOrphans = make(utils.Orphans)
+	nodeOrphans     = make(utils.Orphans)
 
 	consulAgents map[string]*consul.Adapter
+	// externalAgent is Consul Agent which services of the external node are registered by,
+	// nil if there are no such services
+	externalAgent *consul.Adapter
 )
 
 // Controller describes the attributes that are uses by Controller
 type Controller struct {
-	clientset      *kubernetes.Clientset
+	clientset      kubernetes.Interface
 	consulInstance consul.Adapter
 	cfg            *config.Config
 	namespace      string
 	mutex          *sync.Mutex
+	// services keeps Services which own Endpoints, it's the store of Services' watch
+	services cache.Store
 }
 
 // New creates an instance of controller
@@ -50,10 +83,11 @@ func New(clientset *kubernetes.Clientset, consulInstance consul.Adapter, cfg *co
 		consulInstance: consulInstance,
 		cfg:            cfg,
 		namespace:      namespace,
-		mutex:          &sync.Mutex{}}
+		mutex:          &sync.Mutex{},
+		services:       cache.NewStore(cache.MetaNamespaceKeyFunc)}
 }
 
-func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
+func (c *Controller) cacheConsulAgent(services []v1.Service) (map[string]*consul.Adapter, error) {
 	consulAgents = make(map[string]*consul.Adapter)
 	//Cache Consul's Agents
 	if c.cfg.Controller.RegisterMode == config.RegisterSingleMode {
@@ -69,8 +103,12 @@ func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
 		}
 
 		for _, node := range nodes.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+			// The same agent as in registration of services of the node
+			host := node.ObjectMeta.Name
+			if address, ok := c.getNodeAddress(&node); ok {
+				host = address.address
+			}
+			consulAgent := c.consulInstance.NewForNode(c.cfg, node.ObjectMeta.Name, host)
 			consulAgents[node.ObjectMeta.Name] = consulAgent
 		}
 	} else if c.cfg.Controller.RegisterMode == config.RegisterPodMode {
@@ -81,15 +119,86 @@ func (c *Controller) cacheConsulAgent() (map[string]*consul.Adapter, error) {
 			return consulAgents, err
 		}
 		for _, pod := range pods.Items {
-			consulInstance := consul.Adapter{}
-			consulAgent := consulInstance.New(c.cfg, "", pod.Status.HostIP)
+			consulAgent := c.consulInstance.New(c.cfg, pod.Spec.NodeName, pod.Status.HostIP)
 			consulAgents[pod.Status.HostIP] = consulAgent
 		}
+	} else if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		// Node for services which are not bound to Kubernetes node, or for all services in `cluster` mode
+		consulAgents[c.cfg.Controller.CatalogNodeName] = c.consulInstance.New(c.cfg, "", "")
+
+		if c.cfg.Controller.CatalogNodeMode == config.CatalogNodePerNode {
+			nodes, err := c.clientset.CoreV1().Nodes().List(v1.ListOptions{})
+			if err != nil {
+				return consulAgents, err
+			}
+
+			for _, node := range nodes.Items {
+				consulAgent := c.consulInstance.New(c.cfg, node.ObjectMeta.Name, "")
+				consulAgents[node.ObjectMeta.Name] = consulAgent
+			}
+		}
+	}
+
+	// Agent which services of the external node are registered by, it keeps namespaces of listed services
+	externalAgent = nil
+	if c.usesExternalNode(services) {
+		externalAgent = c.consulInstance.NewForAgent(c.cfg, c.cfg.Controller.ConsulAddress)
+	}
+
+	// Agent which ClusterIP and LoadBalancer services are registered in
+	if c.cfg.Controller.RegisterMode != config.RegisterCatalogMode && c.usesFixedAgent(services) {
+		if _, ok := consulAgents[c.cfg.Controller.ClusterIPConsulAddress]; !ok {
+			consulAgents[c.cfg.Controller.ClusterIPConsulAddress] = c.consulInstance.NewForAgent(c.cfg, c.cfg.Controller.ClusterIPConsulAddress)
+		}
 	}
 
 	return consulAgents, nil
 }
 
+// usesFixedAgent checks if services are registered in Consul Agent given by `cluster_ip_consul_address` option,
+// i.e. registration of cluster IP is enabled by option or annotation of any service, there is any `LoadBalancer`
+// service or such services have been registered before
+func (c *Controller) usesFixedAgent(services []v1.Service) bool {
+	if c.cfg.Controller.RegisterClusterIP {
+		return true
+	}
+	for _, registrations := range addedServices {
+		for _, r := range registrations {
+			if r.agentFixed && r.catalogNode == "" {
+				return true
+			}
+		}
+	}
+	for i := range services {
+		svc := &services[i]
+		switch {
+		case svc.Spec.Type == v1.ServiceTypeClusterIP && c.isClusterIPEnabled(svc):
+			return true
+		case svc.Spec.Type == v1.ServiceTypeLoadBalancer && len(svc.Spec.ExternalIPs) == 0:
+			return true
+		}
+	}
+	return false
+}
+
+// usesExternalNode checks if services are registered on the external node in Consul catalog,
+// i.e. there is any `ExternalName` service or such services have been registered before
+func (c *Controller) usesExternalNode(services []v1.Service) bool {
+	for _, registrations := range addedServices {
+		for _, r := range registrations {
+			if r.catalogNode == c.cfg.Controller.ExternalNodeName {
+				return true
+			}
+		}
+	}
+	for i := range services {
+		if services[i].Spec.Type == v1.ServiceTypeExternalName && services[i].Spec.ExternalName != "" {
+			return true
+		}
+	}
+	return false
+}
+
 // Clean checks Consul services and remove them if service does not appear in K8S cluster
 func (c *Controller) Clean() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("clean"))
@@ -99,7 +208,13 @@ func (c *Controller) Clean() error {
 
 	c.mutex.Lock()
 
-	consulAgents, err = c.cacheConsulAgent()
+	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+
+	consulAgents, err = c.cacheConsulAgent(allServices.Items)
 	if err != nil {
 		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
@@ -115,45 +230,104 @@ func (c *Controller) Clean() error {
 	}
 	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
-	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
-	if err != nil {
-		c.mutex.Unlock()
-		return err
+	expectedServices := c.getExpectedServices(allServices.Items)
+
+	missing := getMissingServices(registeredConsulServices, expectedServices)
+	orphaned, held := consul.OrphanedServices(c.cfg, "service", orphans, missing, len(addedConsulServices))
+	for _, serviceID := range held {
+		consulAgents[addedConsulServices[serviceID]].Hold("", &consulapi.AgentServiceRegistration{ID: serviceID})
 	}
+	for _, serviceID := range orphaned {
+		consulAgent := consulAgents[addedConsulServices[serviceID]]
+		consulService := &consulapi.AgentServiceRegistration{
+			ID: serviceID,
+		}
 
-	var currentAddedServices = make(map[string]string)
-	for _, service := range allServices.Items {
-		if !isRegisterEnabled(&service) {
-			continue
+		err = consulAgent.Deregister(consulService)
+		if err != nil {
+			glog.Errorf("Cannot deregister service in Consul: %s", err)
+			metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+		} else {
+			forgetService(serviceID)
+			glog.Infof("Service has been deregistered in Consul with ID: %s", serviceID)
+			metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
 		}
-		currentAddedServices[string(service.ObjectMeta.UID)] = service.ObjectMeta.Name
 	}
 
-	for uid, serviceConsulID := range registeredConsulServices {
-		if name, ok := currentAddedServices[uid]; !ok {
-			for _, serviceID := range serviceConsulID {
-				consulAgent := consulAgents[addedConsulServices[serviceID]]
-				consulService := &consulapi.AgentServiceRegistration{
-					ID: serviceID,
-				}
-
-				err = consulAgent.Deregister(consulService)
-				if err != nil {
-					glog.Errorf("Cannot deregister service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-				} else {
-					delete(allAddedServices, serviceID)
-					glog.Infof("Service %s has been deregistered in Consul with ID: %s", name, serviceID)
-					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-				}
-			}
+	// Deletion of inactive services from the external node
+	addedExternalServices, registeredExternalServices, err := c.getAddedExternalServices()
+	if err != nil {
+		glog.Errorf("Can't get services of external node: %s", err)
+	} else {
+		missingExternal := getMissingServices(registeredExternalServices, expectedServices)
+		orphaned, held := consul.OrphanedServices(c.cfg, "service", externalOrphans, missingExternal, len(addedExternalServices))
+		for _, serviceID := range held {
+			externalAgent.Hold(c.cfg.Controller.ExternalNodeName, &consulapi.AgentServiceRegistration{ID: serviceID})
+		}
+		for _, serviceID := range orphaned {
+			c.deregisterExternalService(serviceID)
 		}
 	}
 
+	if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode {
+		c.consulInstance.CleanInactiveNodes(c.cfg, nodeOrphans, consulAgents)
+	}
+
 	c.mutex.Unlock()
 	return nil
 }
 
+// getExpectedServices returns IDs of Consul services which correspond to current spec of enabled
+// Kubernetes Services, by UID of Kubernetes Service. The set of IDs is nil if registrations of
+// Kubernetes Service can't be determined.
+func (c *Controller) getExpectedServices(services []v1.Service) map[string]map[string]bool {
+	var expectedServices = make(map[string]map[string]bool)
+	for i := range services {
+		svc := &services[i]
+		if !isRegisterEnabled(svc) {
+			continue
+		}
+
+		uid := string(svc.ObjectMeta.UID)
+		registrations, err := c.getRegistrations(svc)
+		if err != nil {
+			glog.Errorf("Can't get registrations of service %s: %s", svc.ObjectMeta.Name, err)
+			expectedServices[uid] = nil
+			continue
+		}
+
+		expectedServices[uid] = make(map[string]bool)
+		for _, r := range registrations {
+			expectedServices[uid][r.service.ID] = true
+		}
+	}
+	return expectedServices
+}
+
+// getMissingServices returns IDs of registered Consul services whose Kubernetes Service doesn't exist,
+// or which don't correspond to current spec of Kubernetes Service anymore, e.g. after change of ports
+// while controller hasn't been running. Registered services are given by UID of Kubernetes Service.
+func getMissingServices(registered map[string][]string, expected map[string]map[string]bool) []string {
+	var missing []string
+	for uid, serviceIDs := range registered {
+		expectedIDs, ok := expected[uid]
+		if !ok {
+			missing = append(missing, serviceIDs...)
+			continue
+		}
+		// Registrations of service are unknown
+		if expectedIDs == nil {
+			continue
+		}
+		for _, serviceID := range serviceIDs {
+			if !expectedIDs[serviceID] {
+				missing = append(missing, serviceID)
+			}
+		}
+	}
+	return missing
+}
+
 // Sync synchronizes services between Consul and K8S cluster
 func (c *Controller) Sync() error {
 	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("sync"))
@@ -163,7 +337,13 @@ func (c *Controller) Sync() error {
 
 	c.mutex.Lock()
 
-	consulAgents, err = c.cacheConsulAgent()
+	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
+	if err != nil {
+		c.mutex.Unlock()
+		return err
+	}
+
+	consulAgents, err = c.cacheConsulAgent(allServices.Items)
 	if err != nil {
 		c.mutex.Unlock()
 		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
@@ -173,103 +353,125 @@ func (c *Controller) Sync() error {
 	// Get list of added Consul' services
 	// addedConsulServices map[string]string serviceConsulID:consul_agent_hostname
 	// registeredConsulServices map[string][]string UID:serviceConsulID
-	addedConsulServices, registeredConsulServices, err := c.getAddedConsulServices()
+	addedConsulServices, _, err := c.getAddedConsulServices()
 	if err != nil {
 		c.mutex.Unlock()
 		return err
 	}
-	glog.V(3).Infof("Added services: %#v", addedConsulServices)
-
-	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
+	addedExternalServices, _, err := c.getAddedExternalServices()
 	if err != nil {
-		c.mutex.Unlock()
-		return err
+		glog.Errorf("Can't get services of external node: %s", err)
+	}
+	for serviceID, node := range addedExternalServices {
+		addedConsulServices[serviceID] = node
 	}
+	glog.V(3).Infof("Added services: %#v", addedConsulServices)
 
 	for _, service := range allServices.Items {
 		if !isRegisterEnabled(&service) {
 			continue
 		}
 
-		// Check if service has already added to Consul
-		if consulServices, ok := registeredConsulServices[string(service.ObjectMeta.UID)]; ok {
-			for _, serviceConsulID := range consulServices {
-				if _, ok := addedConsulServices[serviceConsulID]; !ok {
-					err := c.eventAddFunc(&service)
-					if err != nil {
-						c.mutex.Unlock()
-						return err
-					}
-				}
-			}
-		} else {
-			err := c.eventAddFunc(&service)
-			if err != nil {
-				c.mutex.Unlock()
-				return err
+		// Forget services which don't appear in Consul in order to register them again
+		for serviceConsulID := range addedServices[service.ObjectMeta.UID] {
+			if _, ok := addedConsulServices[serviceConsulID]; !ok {
+				forgetService(serviceConsulID)
 			}
 		}
+
+		err := c.eventUpdateFunc(&service)
+		if err != nil {
+			c.mutex.Unlock()
+			return err
+		}
 	}
 	c.mutex.Unlock()
 	return nil
 }
 
-// nodeDelete deletes service after node deletion
+// nodeDelete deregisters services which have been registered for the deleted node
 func (c *Controller) nodeDelete(obj interface{}) error {
-	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("sync"))
+	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("node_delete"))
 	defer timer.ObserveDuration()
 
-	var err error
-
 	c.mutex.Lock()
-	allAddedServices = make(map[string]bool)
+	nodeName := obj.(*v1.Node).ObjectMeta.Name
+	delete(unhealthyNodes, nodeName)
 
-	consulAgents, err = c.cacheConsulAgent()
-	if err != nil {
-		c.mutex.Unlock()
-		return fmt.Errorf("Can't cache Consul' Agents: %s", err)
+	for _, r := range getNodeRegistrations(nodeName) {
+		c.deregisterService(r)
 	}
-	glog.V(2).Infof("Agents: %#v", consulAgents)
 
-	// Get list of added Consul' services
-	// addedConsulServices map[string]string serviceConsulID:consul_agent_hostname
-	// registeredConsulServices map[string][]string UID:serviceConsulID
-	addedConsulServices, _, err := c.getAddedConsulServices()
-	if err != nil {
-		c.mutex.Unlock()
-		return err
-	}
-	glog.V(3).Infof("Added services: %#v", addedConsulServices)
+	c.mutex.Unlock()
+	return nil
+}
 
-	for serviceConsulID, consulAgentHostname := range addedConsulServices {
-		for _, address := range obj.(*v1.Node).Status.Addresses {
-			if strings.Contains(serviceConsulID, "-"+address.Address+"-") {
-				consulAgent := consulAgents[consulAgentHostname]
-				consulService := &consulapi.AgentServiceRegistration{
-					ID: serviceConsulID,
-				}
+// nodeUpdate updates services registered for the node whose health has changed.
+// Depending on `node_unhealthy_action` option the services are put in maintenance mode
+// or removed from Consul, and restored when node recovers.
+func (c *Controller) nodeUpdate(node *v1.Node) error {
+	timer := prometheus.NewTimer(metrics.FuncDuration.WithLabelValues("node_update"))
+	defer timer.ObserveDuration()
 
-				err = consulAgent.Deregister(consulService)
-				if err != nil {
-					glog.Errorf("Cannot deregister service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-				} else {
-					delete(allAddedServices, serviceConsulID)
-					glog.Infof("Service has been deregistered in Consul with ID: %s", serviceConsulID)
-					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-				}
-			}
+	reason := getNodeUnhealthyReason(node)
+	if reason != "" {
+		glog.Warningf("Node %s is unhealthy: %s", node.ObjectMeta.Name, reason)
+		unhealthyNodes[node.ObjectMeta.Name] = reason
+	} else {
+		glog.Infof("Node %s is healthy", node.ObjectMeta.Name)
+		delete(unhealthyNodes, node.ObjectMeta.Name)
+	}
+
+	if c.cfg.Controller.NodeUnhealthyAction == config.NodeUnhealthyMaintenance {
+		for _, r := range getNodeRegistrations(node.ObjectMeta.Name) {
+			c.setMaintenance(r, reason)
 		}
+		return nil
 	}
 
-	c.mutex.Unlock()
+	// Services of unhealthy nodes are omitted during registration
+	allServices, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, service := range allServices.Items {
+		if !isRegisterEnabled(&service) {
+			continue
+		}
+		if err := c.eventUpdateFunc(&service); err != nil {
+			glog.Errorf("Failed to update service %s: %s", service.ObjectMeta.Name, err)
+		}
+	}
 	return nil
 }
 
+// setMaintenance puts service in maintenance mode if reason is given, otherwise disables maintenance mode
+func (c *Controller) setMaintenance(r *registration, reason string) {
+	var err error
+	var operation string
+
+	consulAgent := c.getConsulAgent(r)
+	if reason != "" {
+		operation = "maintenance_enable"
+		err = consulAgent.EnableMaintenance(r.service, reason)
+	} else {
+		operation = "maintenance_disable"
+		err = consulAgent.DisableMaintenance(r.service)
+	}
+	if err != nil {
+		glog.Errorf("Cannot change maintenance mode of service in Consul: %s", err)
+		metrics.ConsulFailure.WithLabelValues(operation, consulAgent.Config.Address).Inc()
+	} else {
+		glog.Infof("Maintenance mode of service with ID %s has been changed, reason: %q", r.service.ID, reason)
+		metrics.ConsulSuccess.WithLabelValues(operation, consulAgent.Config.Address).Inc()
+	}
+}
+
 // Watch watches events in K8S cluster
 func (c *Controller) Watch() {
 	go c.watchNodes()
 	go c.watchServices()
+	go c.watchEndpoints()
 }
 
 func (c *Controller) watchNodes() {
@@ -285,7 +487,9 @@ func (c *Controller) watchNodes() {
 				glog.Info("Add node.")
 				allServices, err := c.clientset.CoreV1().Services(c.namespace).List(v1.ListOptions{})
 				if err != nil {
+					glog.Errorf("Failed to add node: %s", err)
 					c.mutex.Unlock()
+					return
 				}
 
 				for _, service := range allServices.Items {
@@ -306,6 +510,46 @@ func (c *Controller) watchNodes() {
 					glog.Error(err)
 				}
 			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if getNodeUnhealthyReason(oldObj.(*v1.Node)) == getNodeUnhealthyReason(newObj.(*v1.Node)) {
+					return
+				}
+
+				c.mutex.Lock()
+				if err := c.nodeUpdate(newObj.(*v1.Node)); err != nil {
+					glog.Errorf("Failed to update node: %s", err)
+				}
+				c.mutex.Unlock()
+			},
+		},
+	)
+
+	stop := make(chan struct{})
+	controller.Run(stop)
+}
+
+// watchEndpoints watches endpoints in order to update registrations of services
+// which depend on location of pods, i.e. services with local external traffic policy
+// and headless services
+func (c *Controller) watchEndpoints() {
+	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "endpoints", c.namespace,
+		fields.Everything())
+	_, controller := cache.NewInformer(
+		watchlist,
+		&v1.Endpoints{},
+		time.Second*0,
+		cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				if reflect.DeepEqual(oldObj.(*v1.Endpoints).Subsets, newObj.(*v1.Endpoints).Subsets) {
+					return
+				}
+
+				c.mutex.Lock()
+				if err := c.endpointsUpdate(newObj.(*v1.Endpoints)); err != nil {
+					glog.Errorf("Failed to update services after endpoints update: %s", err)
+				}
+				c.mutex.Unlock()
+			},
 		},
 	)
 
@@ -313,10 +557,39 @@ func (c *Controller) watchNodes() {
 	controller.Run(stop)
 }
 
+// endpointsUpdate updates registrations of service which owns the endpoints
+// if the registrations depend on location of pods, service is taken from the store of Services
+func (c *Controller) endpointsUpdate(endpoints *v1.Endpoints) error {
+	key := fmt.Sprintf("%s/%s", endpoints.ObjectMeta.Namespace, endpoints.ObjectMeta.Name)
+	obj, exists, err := c.services.GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		// Service isn't in the store yet or it's been deleted, it's registered by its own watch
+		glog.V(2).Infof("Can't find service %s of endpoints", key)
+		return nil
+	}
+	svc := obj.(*v1.Service)
+
+	if !isRegisterEnabled(svc) {
+		return nil
+	}
+
+	isHeadless := svc.Spec.ClusterIP == v1.ClusterIPNone && c.isClusterIPEnabled(svc) &&
+		c.cfg.Controller.ClusterIPHeadless == config.HeadlessEndpointsMode
+	if !isLocalTraffic(svc) && !isHeadless {
+		return nil
+	}
+
+	glog.V(2).Infof("Endpoints of service %s have changed", svc.ObjectMeta.Name)
+	return c.eventUpdateFunc(svc)
+}
+
 func (c *Controller) watchServices() {
 	watchlist := cache.NewListWatchFromClient(c.clientset.CoreV1().RESTClient(), "services", c.namespace,
 		fields.Everything())
-	_, controller := cache.NewInformer(
+	store, controller := cache.NewInformer(
 		watchlist,
 		&v1.Service{},
 		time.Second*0,
@@ -357,8 +630,8 @@ func (c *Controller) watchServices() {
 					c.mutex.Unlock()
 				} else {
 					c.mutex.Lock()
-					if err := c.eventAddFunc(newObj); err != nil {
-						glog.Errorf("Failed to add services during update: %s", err)
+					if err := c.eventUpdateFunc(newObj); err != nil {
+						glog.Errorf("Failed to update services: %s", err)
 					}
 					c.mutex.Unlock()
 				}
@@ -366,6 +639,11 @@ func (c *Controller) watchServices() {
 		},
 	)
 
+	// Services which own Endpoints are taken from the store instead of API
+	c.mutex.Lock()
+	c.services = store
+	c.mutex.Unlock()
+
 	stop := make(chan struct{})
 	controller.Run(stop)
 }
@@ -383,7 +661,7 @@ func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]s
 		} else {
 			glog.V(3).Infof("agent: %#v, services: %#v", consulAgentID, services)
 			for _, service := range services {
-				if utils.CheckK8sTag(service.Tags, c.cfg.Controller.K8sTag) {
+				if consul.IsOwned(c.cfg, service.Tags, service.Meta) {
 					addedServices[service.ID] = consulAgentID
 
 					uid := utils.GetConsulServiceTag(service.Tags, "uid")
@@ -399,104 +677,405 @@ func (c *Controller) getAddedConsulServices() (map[string]string, map[string][]s
 	return addedServices, registeredConsulServices, nil
 }
 
+// getAddedExternalServices returns the list of services registered on the external node in Consul catalog.
+// The external node isn't queried if there are no services of the external node.
+func (c *Controller) getAddedExternalServices() (map[string]string, map[string][]string, error) {
+	var addedServices = make(map[string]string)
+	var registeredConsulServices = make(map[string][]string)
+
+	if externalAgent == nil {
+		return addedServices, registeredConsulServices, nil
+	}
+	services, err := externalAgent.CatalogServices(c.cfg.Controller.ExternalNodeName)
+	if err != nil {
+		return addedServices, registeredConsulServices, err
+	}
+
+	for _, service := range services {
+		if consul.IsOwned(c.cfg, service.Tags, service.Meta) {
+			addedServices[service.ID] = c.cfg.Controller.ExternalNodeName
+
+			uid := utils.GetConsulServiceTag(service.Tags, "uid")
+			registeredConsulServices[uid] = append(registeredConsulServices[uid], service.ID)
+		}
+	}
+	return addedServices, registeredConsulServices, nil
+}
+
+// deregisterExternalService deregisters service from the external node in Consul catalog,
+// namespace of service is taken from the last listing of services of the external node
+func (c *Controller) deregisterExternalService(serviceID string) {
+	err := externalAgent.CatalogDeregister(c.cfg.Controller.ExternalNodeName, &consulapi.AgentServiceRegistration{ID: serviceID})
+	if err != nil {
+		glog.Errorf("Cannot deregister service in Consul: %s", err)
+		metrics.ConsulFailure.WithLabelValues("deregister", externalAgent.Config.Address).Inc()
+	} else {
+		forgetService(serviceID)
+		glog.Infof("Service has been deregistered from external node in Consul with ID: %s", serviceID)
+		metrics.ConsulSuccess.WithLabelValues("deregister", externalAgent.Config.Address).Inc()
+	}
+}
+
 func (c *Controller) eventAddFunc(obj interface{}) error {
 	if !isRegisterEnabled(obj) {
 		return nil
 	}
 
-	var nodesIPs []string
-	var ports []int32
+	registrations, err := c.getRegistrations(obj.(*v1.Service))
+	if err != nil {
+		return err
+	}
+
+	// Now is time to add service to Consul
+	c.registerServices(obj.(*v1.Service), registrations)
+	return nil
+}
+
+// eventUpdateFunc registers services which are missing in Consul and deregisters services
+// which don't correspond to current spec of Kubernetes Service anymore,
+// e.g. after change of ports, external IPs or type of service.
+func (c *Controller) eventUpdateFunc(obj interface{}) error {
+	svc := obj.(*v1.Service)
+
+	registrations, err := c.getRegistrations(svc)
+	if err != nil {
+		return err
+	}
+
+	var expectedServices = make(map[string]bool)
+	for _, r := range registrations {
+		expectedServices[r.service.ID] = true
+	}
+
+	for serviceID, r := range addedServices[svc.ObjectMeta.UID] {
+		if _, ok := expectedServices[serviceID]; !ok {
+			c.deregisterService(r)
+		}
+	}
+
+	c.registerServices(svc, registrations)
+	return nil
+}
+
+// getRegistrations returns the list of Consul services which represent given Kubernetes Service.
+// The address of service depends on type of service:
+// `NodePort` - IP addresses of nodes together with `nodePort`,
+// `LoadBalancer` - IP addresses or hostnames of load balancer ingress together with `port`,
+// `ClusterIP` - cluster IP together with `port` if registration of cluster IP is enabled.
+// `LoadBalancer` and `ClusterIP` services are registered in Consul Agent given by `cluster_ip_consul_address` option.
+// If service has `externalIPs` then these are used together with `port` instead.
+func (c *Controller) getRegistrations(svc *v1.Service) ([]*registration, error) {
+	var addresses []targetAddress
 	var err error
 
-	switch serviceType := obj.(*v1.Service).Spec.Type; serviceType {
-	case v1.ServiceTypeNodePort:
-		// Check if ExternalIPs is empty
-		if len(obj.(*v1.Service).Spec.ExternalIPs) > 0 {
-			nodesIPs = obj.(*v1.Service).Spec.ExternalIPs
-		} else {
-			nodesIPs, err = c.getNodesIPs()
+	useNodePort := false
+	agentFixed := false
+
+	switch serviceType := svc.Spec.Type; {
+	case serviceType == v1.ServiceTypeExternalName:
+		return c.getExternalNameRegistrations(svc)
+	case serviceType == v1.ServiceTypeClusterIP && c.isClusterIPEnabled(svc):
+		if svc.Spec.ClusterIP == v1.ClusterIPNone {
+			if c.cfg.Controller.ClusterIPHeadless == config.HeadlessEndpointsMode {
+				return c.getHeadlessRegistrations(svc)
+			}
+			glog.V(2).Infof("Service %s is headless. Skipping registering.", svc.ObjectMeta.Name)
+			return nil, nil
+		}
+		addresses = toTargetAddresses([]string{svc.Spec.ClusterIP})
+		agentFixed = true
+	case len(svc.Spec.ExternalIPs) > 0:
+		addresses = toTargetAddresses(svc.Spec.ExternalIPs)
+	case serviceType == v1.ServiceTypeNodePort:
+		var nodeNames map[string]bool
+		// Only nodes with ready pod of service handle the traffic
+		if isLocalTraffic(svc) {
+			nodeNames, err = c.getEndpointsNodeNames(svc)
 			if err != nil {
-				return err
+				return nil, err
 			}
 		}
-		for _, port := range obj.(*v1.Service).Spec.Ports {
-			if port.Protocol == v1.ProtocolTCP {
-				ports = append(ports, port.NodePort)
+		addresses, err = c.getNodesAddresses(nodeNames)
+		if err != nil {
+			return nil, err
+		}
+		useNodePort = true
+	case serviceType == v1.ServiceTypeLoadBalancer:
+		addresses = toTargetAddresses(getLoadBalancerIngress(svc))
+		if len(addresses) == 0 {
+			glog.V(2).Infof("Service %s has no load balancer ingress yet", svc.ObjectMeta.Name)
+		}
+		// Load balancer doesn't run Consul Agent
+		agentFixed = true
+	}
+
+	return c.toRegistrations(svc, addresses, useNodePort, agentFixed), nil
+}
+
+// toRegistrations returns Consul services for every port of service and every address
+func (c *Controller) toRegistrations(svc *v1.Service, addresses []targetAddress, useNodePort bool, agentFixed bool) []*registration {
+	var registrations []*registration
+
+	tcpPorts := getTCPPorts(svc.Spec.Ports, useNodePort)
+	for _, port := range svc.Spec.Ports {
+		if !isProtocolSupported(port.Protocol) {
+			glog.Warningf("Protocol %s of port %d in service %s is not supported. Omitted.", port.Protocol, port.Port, svc.ObjectMeta.Name)
+			continue
+		}
+
+		servicePort := port.Port
+		if useNodePort {
+			servicePort = port.NodePort
+		}
+
+		for _, address := range addresses {
+			service, err := c.createConsulService(svc, address.address, servicePort, port.Protocol, tcpPorts)
+			if err != nil {
+				glog.Errorf("Cannot create Consul service: %s", err)
+				continue
+			}
+			for tag, taggedAddress := range address.taggedAddresses {
+				if service.TaggedAddresses == nil {
+					service.TaggedAddresses = make(map[string]consulapi.ServiceAddress)
+				}
+				service.TaggedAddresses[tag] = consulapi.ServiceAddress{Address: taggedAddress, Port: int(servicePort)}
+			}
+			r := &registration{service: service, agentAddress: address.address, nodeName: address.nodeName}
+			if agentFixed {
+				r.agentAddress = c.cfg.Controller.ClusterIPConsulAddress
+				r.agentFixed = true
 			}
+			registrations = append(registrations, r)
 		}
+	}
+	return registrations
+}
+
+// getExternalNameRegistrations returns the list of Consul services which represent
+// Kubernetes Service with type `ExternalName`. Services are registered in Consul catalog
+// on the external node, with external name as address of Consul service.
+func (c *Controller) getExternalNameRegistrations(svc *v1.Service) ([]*registration, error) {
+	var registrations []*registration
+
+	if svc.Spec.ExternalName == "" {
+		return nil, nil
+	}
+
+	ports := svc.Spec.Ports
+	// Service without ports is registered once without port
+	if len(ports) == 0 {
+		ports = []v1.ServicePort{{Protocol: v1.ProtocolTCP}}
+	}
+
+	tcpPorts := getTCPPorts(ports, false)
+	for _, port := range ports {
+		service, err := c.createConsulService(svc, svc.Spec.ExternalName, port.Port, port.Protocol, tcpPorts)
+		if err != nil {
+			glog.Errorf("Cannot create Consul service: %s", err)
+			continue
+		}
+		registrations = append(registrations, &registration{
+			service:      service,
+			agentAddress: c.cfg.Controller.ConsulAddress,
+			agentFixed:   true,
+			catalogNode:  c.cfg.Controller.ExternalNodeName,
+		})
+	}
+	return registrations, nil
+}
 
-		// Now is time to add service to Consul
-		for _, nodeAddress := range nodesIPs {
-			for _, port := range ports {
-				// Add to Consul
-				service, err := c.createConsulService(obj.(*v1.Service), nodeAddress, port)
+// getHeadlessRegistrations returns the list of Consul services which represent
+// ready endpoints of headless Kubernetes Service
+func (c *Controller) getHeadlessRegistrations(svc *v1.Service) ([]*registration, error) {
+	var registrations []*registration
+
+	endpoints, err := c.clientset.CoreV1().Endpoints(svc.ObjectMeta.Namespace).Get(svc.ObjectMeta.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subset := range endpoints.Subsets {
+		var tcpPorts = make(map[int32]bool)
+		for _, port := range subset.Ports {
+			if port.Protocol == "" || port.Protocol == v1.ProtocolTCP {
+				tcpPorts[port.Port] = true
+			}
+		}
+
+		for _, port := range subset.Ports {
+			if !isProtocolSupported(port.Protocol) {
+				continue
+			}
+			for _, address := range subset.Addresses {
+				service, err := c.createConsulService(svc, address.IP, port.Port, port.Protocol, tcpPorts)
 				if err != nil {
 					glog.Errorf("Cannot create Consul service: %s", err)
 					continue
 				}
-				// Check if service's already added
-				if _, ok := allAddedServices[service.ID]; ok {
-					glog.V(3).Infof("Service %s has already registered in Consul", service.ID)
-					continue
-				}
+				registrations = append(registrations, &registration{
+					service:      service,
+					agentAddress: c.cfg.Controller.ClusterIPConsulAddress,
+					agentFixed:   true,
+				})
+			}
+		}
+	}
+	return registrations, nil
+}
 
-				consulAgent := c.consulInstance.New(c.cfg, nodeAddress, "")
-				err = consulAgent.Register(service)
-				if err != nil {
-					glog.Errorf("Cannot register service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
-				} else {
-					allAddedServices[service.ID] = true
-					glog.Infof("Service %s has been registered in Consul with ID: %s", obj.(*v1.Service).ObjectMeta.Name, service.ID)
-					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
-				}
+// isClusterIPEnabled checks if service should be registered with its cluster IP.
+// The annotation of service takes precedence over `register_cluster_ip` option.
+func (c *Controller) isClusterIPEnabled(svc *v1.Service) bool {
+	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterClusterIPAnnotation]; ok {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterClusterIPAnnotation, err)
+			return false
+		}
+		return enabled
+	}
+	return c.cfg.Controller.RegisterClusterIP
+}
+
+// registerServices registers Consul services which haven't been registered yet
+func (c *Controller) registerServices(svc *v1.Service, registrations []*registration) {
+	for _, r := range registrations {
+		// Check if service's already added, the service is updated in place when its registration has changed
+		if added, ok := addedServices[svc.ObjectMeta.UID][r.service.ID]; ok {
+			if !consul.IsServiceChanged(added.service, r.service) {
+				glog.V(3).Infof("Service %s has already registered in Consul", r.service.ID)
+				continue
 			}
+			glog.Infof("Service %s has changed, updating service in Consul", r.service.ID)
 		}
-	case v1.ServiceTypeClusterIP:
-		// Check if ExternalIPs is empty
-		if len(obj.(*v1.Service).Spec.ExternalIPs) > 0 {
-			nodesIPs = obj.(*v1.Service).Spec.ExternalIPs
+
+		var err error
+		consulAgent := c.getConsulAgent(r)
+		if r.catalogNode != "" {
+			err = consulAgent.CatalogRegister(r.catalogNode, r.service)
 		} else {
-			return nil
+			err = consulAgent.Register(r.service)
 		}
-		for _, port := range obj.(*v1.Service).Spec.Ports {
-			if port.Protocol == v1.ProtocolTCP {
-				ports = append(ports, port.NodePort)
+		if err != nil {
+			glog.Errorf("Cannot register service in Consul: %s", err)
+			metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
+		} else {
+			rememberService(svc.ObjectMeta.UID, r)
+			glog.Infof("Service %s has been registered in Consul with ID: %s", svc.ObjectMeta.Name, r.service.ID)
+			metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
+
+			if reason, ok := unhealthyNodes[r.nodeName]; ok && r.nodeName != "" {
+				c.setMaintenance(r, reason)
 			}
 		}
+	}
+}
 
-		// Now is time to add service to Consul
-		for _, nodeAddress := range nodesIPs {
-			for _, port := range ports {
-				// Add to Consul
-				service, err := c.createConsulService(obj.(*v1.Service), nodeAddress, port)
-				if err != nil {
-					glog.Errorf("Cannot create Consul service: %s", err)
-					continue
-				}
-				// Check if service's already added
-				if _, ok := allAddedServices[service.ID]; ok {
-					glog.V(3).Infof("Service %s has already registered in Consul", service.ID)
-					continue
-				}
+// deregisterService deregisters Consul service from Consul Agent which the service is registered in
+func (c *Controller) deregisterService(r *registration) {
+	var err error
+	consulAgent := c.getConsulAgent(r)
+	if r.catalogNode != "" {
+		err = consulAgent.CatalogDeregister(r.catalogNode, r.service)
+	} else {
+		err = consulAgent.Deregister(r.service)
+	}
+	if err != nil {
+		glog.Errorf("Cannot deregister service in Consul: %s", err)
+		metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+	} else {
+		forgetService(r.service.ID)
+		glog.Infof("Service %s has been deregistered in Consul with ID: %s", r.service.Name, r.service.ID)
+		metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
+	}
+}
 
-				consulAgent := c.consulInstance.New(c.cfg, nodeAddress, "")
-				err = consulAgent.Register(service)
-				if err != nil {
-					glog.Errorf("Cannot register service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("register", consulAgent.Config.Address).Inc()
-				} else {
-					allAddedServices[service.ID] = true
-					glog.Infof("Service %s has been registered in Consul with ID: %s", obj.(*v1.Service).ObjectMeta.Name, service.ID)
-					metrics.ConsulSuccess.WithLabelValues("register", consulAgent.Config.Address).Inc()
-				}
+// getConsulAgent returns Consul Agent which the registration belongs to
+func (c *Controller) getConsulAgent(r *registration) *consul.Adapter {
+	// In catalog mode services are registered on synthetic node of Kubernetes node
+	if c.cfg.Controller.RegisterMode == config.RegisterCatalogMode && r.catalogNode == "" {
+		return c.consulInstance.New(c.cfg, r.nodeName, "")
+	}
+	if r.agentFixed {
+		return c.consulInstance.NewForAgent(c.cfg, r.agentAddress)
+	}
+	// Agent of node is looked up by name of node, address of node is used if the agent isn't overridden or discovered
+	return c.consulInstance.NewForNode(c.cfg, r.nodeName, r.agentAddress)
+}
+
+// getTCPPorts returns numbers of TCP ports of service, node ports are returned if useNodePort is set
+func getTCPPorts(ports []v1.ServicePort, useNodePort bool) map[int32]bool {
+	var tcpPorts = make(map[int32]bool)
+	for _, port := range ports {
+		if port.Protocol != "" && port.Protocol != v1.ProtocolTCP {
+			continue
+		}
+		if useNodePort {
+			tcpPorts[port.NodePort] = true
+		} else {
+			tcpPorts[port.Port] = true
+		}
+	}
+	return tcpPorts
+}
+
+// getLoadBalancerIngress returns IPs or hostnames of load balancer ingress points
+func getLoadBalancerIngress(svc *v1.Service) []string {
+	var addresses []string
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			addresses = append(addresses, ingress.IP)
+		} else if ingress.Hostname != "" {
+			addresses = append(addresses, ingress.Hostname)
+		}
+	}
+	return addresses
+}
+
+// rememberService marks Consul service as registered for Kubernetes Service with given UID
+func rememberService(uid types.UID, r *registration) {
+	if _, ok := addedServices[uid]; !ok {
+		addedServices[uid] = make(map[string]*registration)
+	}
+	addedServices[uid][r.service.ID] = r
+}
+
+// forgetService removes Consul service from the list of registered services
+func forgetService(serviceID string) {
+	for uid, services := range addedServices {
+		if _, ok := services[serviceID]; ok {
+			delete(services, serviceID)
+			if len(services) == 0 {
+				delete(addedServices, uid)
 			}
 		}
 	}
-	return nil
 }
 
-func (c *Controller) getNodesIPs() ([]string, error) {
+// getEndpointsNodeNames returns names of nodes which run ready pods of service
+func (c *Controller) getEndpointsNodeNames(svc *v1.Service) (map[string]bool, error) {
+	var nodeNames = make(map[string]bool)
+
+	endpoints, err := c.clientset.CoreV1().Endpoints(svc.ObjectMeta.Namespace).Get(svc.ObjectMeta.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.NodeName != nil {
+				nodeNames[*address.NodeName] = true
+			}
+		}
+	}
+	return nodeNames, nil
+}
+
+// getNodesAddresses returns addresses of nodes. If nodeNames is not nil
+// then only addresses of nodes with given names are returned.
+// For every node one address is returned, its type is chosen according to `node_address_types` option.
+// Internal and external IP of node are returned as `lan` and `wan` tagged addresses.
+func (c *Controller) getNodesAddresses(nodeNames map[string]bool) ([]targetAddress, error) {
 	var listOptions v1.ListOptions
 	if c.cfg.Controller.RegisterMode == config.RegisterNodeMode {
 		listOptions.LabelSelector = c.cfg.Controller.ConsulNodeSelector
@@ -505,83 +1084,164 @@ func (c *Controller) getNodesIPs() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return c.nodesToAddresses(nodes.Items, nodeNames), nil
+}
 
-	var addresses []string
-	for _, node := range nodes.Items {
-		for _, address := range node.Status.Addresses {
-			switch addressType := address.Type; addressType {
-			case v1.NodeExternalIP:
-				addresses = append(addresses, address.Address)
-			case v1.NodeInternalIP:
-				addresses = append(addresses, address.Address)
+// nodesToAddresses returns addresses of given nodes. If list of node names is given then only these nodes are taken into account.
+func (c *Controller) nodesToAddresses(nodes []v1.Node, nodeNames map[string]bool) []targetAddress {
+	var addresses []targetAddress
+	for _, node := range nodes {
+		if _, ok := nodeNames[node.ObjectMeta.Name]; nodeNames != nil && !ok {
+			continue
+		}
+
+		if reason := getNodeUnhealthyReason(&node); reason != "" {
+			unhealthyNodes[node.ObjectMeta.Name] = reason
+			if c.cfg.Controller.NodeUnhealthyAction == config.NodeUnhealthyRemove {
+				glog.V(2).Infof("Node %s is unhealthy: %s. Omitted.", node.ObjectMeta.Name, reason)
+				continue
 			}
+		} else {
+			delete(unhealthyNodes, node.ObjectMeta.Name)
 		}
+
+		address, ok := c.getNodeAddress(&node)
+		if !ok {
+			glog.Warningf("Node %s has no address of types: %v", node.ObjectMeta.Name, c.cfg.Controller.NodeAddressTypes)
+			continue
+		}
+		addresses = append(addresses, address)
 	}
-	return addresses, nil
+	return addresses
 }
 
-func (c *Controller) eventDeleteFunc(obj interface{}) error {
-	var nodesIPs []string
-	var ports []int32
-	var err error
+// getNodeAddress returns address of node with the first type from `node_address_types` option
+func (c *Controller) getNodeAddress(node *v1.Node) (targetAddress, bool) {
+	var address targetAddress
+	var nodeAddresses = make(map[v1.NodeAddressType]string)
 
-	switch serviceType := obj.(*v1.Service).Spec.Type; serviceType {
-	case v1.ServiceTypeNodePort:
-		// Check if ExternalIPs is empty
-		if len(obj.(*v1.Service).Spec.ExternalIPs) > 0 {
-			nodesIPs = obj.(*v1.Service).Spec.ExternalIPs
-		} else {
-			nodesIPs, err = c.getNodesIPs()
-			if err != nil {
-				return err
-			}
+	for _, nodeAddress := range node.Status.Addresses {
+		if _, ok := nodeAddresses[nodeAddress.Type]; !ok {
+			nodeAddresses[nodeAddress.Type] = nodeAddress.Address
+		}
+	}
+
+	for _, addressType := range c.cfg.Controller.NodeAddressTypes {
+		if value, ok := nodeAddresses[v1.NodeAddressType(addressType)]; ok {
+			address.address = value
+			break
+		}
+	}
+	if address.address == "" {
+		return address, false
+	}
+	address.nodeName = node.ObjectMeta.Name
+
+	address.taggedAddresses = make(map[string]string)
+	if value, ok := nodeAddresses[v1.NodeInternalIP]; ok {
+		address.taggedAddresses["lan"] = value
+	}
+	if value, ok := nodeAddresses[v1.NodeExternalIP]; ok {
+		address.taggedAddresses["wan"] = value
+	}
+	return address, true
+}
+
+// getNodeUnhealthyReason returns the reason why node is unhealthy, i.e. node is not ready,
+// is cordoned or has taint with `NoExecute` effect. Empty string is returned for healthy node.
+func getNodeUnhealthyReason(node *v1.Node) string {
+	ready := false
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady && condition.Status == v1.ConditionTrue {
+			ready = true
 		}
-		for _, port := range obj.(*v1.Service).Spec.Ports {
-			if port.Protocol == v1.ProtocolTCP {
-				ports = append(ports, port.NodePort)
+	}
+	if !ready {
+		return "Node is not ready"
+	}
+
+	if node.Spec.Unschedulable {
+		return "Node is cordoned"
+	}
+
+	if value, ok := node.ObjectMeta.Annotations[TaintsAnnotation]; ok && value != "" {
+		var taints []v1.Taint
+		if err := json.Unmarshal([]byte(value), &taints); err != nil {
+			glog.Errorf("Can't parse taints of node %s: %s", node.ObjectMeta.Name, err)
+		}
+		for _, taint := range taints {
+			if taint.Effect == taintEffectNoExecute {
+				return fmt.Sprintf("Node has taint %s with effect %s", taint.Key, taint.Effect)
 			}
 		}
+	}
+	return ""
+}
 
-		// Now is time to deregister services from Consul
-		for _, nodeAddress := range nodesIPs {
-			for _, port := range ports {
-				// Add to Consul
-				service, err := c.createConsulService(obj.(*v1.Service), nodeAddress, port)
-				if err != nil {
-					glog.Errorf("Cannot create Consul service: %s", err)
-					continue
-				}
-				// Check if service's already added
-				if _, ok := allAddedServices[service.ID]; !ok {
-					glog.V(3).Infof("Service %s has already been deleted in Consul", service.ID)
-					continue
-				}
-				consulAgent := c.consulInstance.New(c.cfg, nodeAddress, "")
-				err = consulAgent.Deregister(service)
-				if err != nil {
-					glog.Errorf("Cannot deregister service in Consul: %s", err)
-					metrics.ConsulFailure.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-				} else {
-					glog.Infof("Service %s has been deregistered in Consul with ID: %s", obj.(*v1.Service).ObjectMeta.Name, service.ID)
-					metrics.ConsulSuccess.WithLabelValues("deregister", consulAgent.Config.Address).Inc()
-					delete(allAddedServices, service.ID)
-				}
+// getNodeRegistrations returns registrations of services registered for the node with given name
+func getNodeRegistrations(nodeName string) []*registration {
+	var registrations []*registration
+	for _, services := range addedServices {
+		for _, r := range services {
+			if r.nodeName == nodeName {
+				registrations = append(registrations, r)
 			}
 		}
 	}
+	return registrations
+}
+
+// toTargetAddresses converts list of addresses into list of targetAddress
+func toTargetAddresses(addresses []string) []targetAddress {
+	var targetAddresses []targetAddress
+	for _, address := range addresses {
+		targetAddresses = append(targetAddresses, targetAddress{address: address})
+	}
+	return targetAddresses
+}
+
+// eventDeleteFunc deregisters all Consul services which have been registered for Kubernetes Service.
+// Services registered before start of controller are removed during cleaning.
+func (c *Controller) eventDeleteFunc(obj interface{}) error {
+	svc := obj.(*v1.Service)
+
+	for _, r := range addedServices[svc.ObjectMeta.UID] {
+		c.deregisterService(r)
+	}
 	return nil
 }
 
-func (c *Controller) createConsulService(svc *v1.Service, address string, port int32) (*consulapi.AgentServiceRegistration, error) {
+// createConsulService converts address and port of service into Consul service, tcpPorts are numbers
+// of TCP ports registered together with the port. The protocol is added as suffix of ID according to
+// utils.ProtocolSuffix, the same as in `endpoint` source.
+func (c *Controller) createConsulService(svc *v1.Service, address string, port int32, protocol v1.Protocol, tcpPorts map[int32]bool) (*consulapi.AgentServiceRegistration, error) {
 	service := &consulapi.AgentServiceRegistration{}
 
-	service.ID = fmt.Sprintf("%s-%s-%s-%d", svc.ObjectMeta.Name, svc.ObjectMeta.UID, address, port)
+	if protocol == "" {
+		protocol = v1.ProtocolTCP
+	}
+
+	service.ID = fmt.Sprintf("%s-%s-%s-%d%s", svc.ObjectMeta.Name, svc.ObjectMeta.UID, address, port,
+		utils.ProtocolSuffix(port, protocol, tcpPorts))
 	service.Name = svc.ObjectMeta.Name
+	service.Namespace = consul.Namespace(c.cfg, svc.ObjectMeta.Namespace)
 
 	//Add K8sTag from configuration
 	service.Tags = []string{c.cfg.Controller.K8sTag}
 	service.Tags = append(service.Tags, fmt.Sprintf("uid:%s", svc.ObjectMeta.UID))
+	service.Tags = append(service.Tags, fmt.Sprintf("protocol:%s", strings.ToLower(string(protocol))))
 	service.Tags = append(service.Tags, labelsToTags(svc.ObjectMeta.Labels)...)
+	service.Meta = map[string]string{"protocol": strings.ToLower(string(protocol))}
+	consul.SetOwner(c.cfg, service)
+
+	if value, ok := svc.ObjectMeta.Annotations[ConsulRegisterServiceWeightAnnotation]; ok {
+		weights, err := utils.ParseWeights(value)
+		if err != nil {
+			glog.Errorf("Can't convert value of %s annotation: %s", ConsulRegisterServiceWeightAnnotation, err)
+		} else {
+			service.Weights = weights
+		}
+	}
 
 	service.Port = int(port)
 	service.Address = address
@@ -604,6 +1264,25 @@ func labelsToTags(labels map[string]string) []string {
 
 }
 
+// isLocalTraffic checks if service routes external traffic only to pods on the same node
+func isLocalTraffic(svc *v1.Service) bool {
+	switch svc.ObjectMeta.Annotations[ExternalTrafficAnnotation] {
+	case "OnlyLocal", "Local":
+		return true
+	}
+	return false
+}
+
+// isProtocolSupported checks if port with given protocol can be registered in Consul,
+// empty protocol means TCP, e.g. in manifests of `simulate` subcommand
+func isProtocolSupported(protocol v1.Protocol) bool {
+	switch protocol {
+	case "", v1.ProtocolTCP, v1.ProtocolUDP, protocolSCTP:
+		return true
+	}
+	return false
+}
+
 func isRegisterEnabled(obj interface{}) bool {
 	if value, ok := obj.(*v1.Service).ObjectMeta.Annotations[ConsulRegisterEnabledAnnotation]; ok {
 		enabled, err := strconv.ParseBool(value)
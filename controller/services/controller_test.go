@@ -0,0 +1,696 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/consul"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/runtime"
+	"k8s.io/client-go/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestGetConsulAgentOverriddenNode(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:               "kubernetes",
+			ConsulScheme:         "http",
+			ConsulPort:           "8500",
+			RegisterMode:         config.RegisterNodeMode,
+			NodeAddressTypes:     []string{string(v1.NodeInternalIP)},
+			ConsulAgentAddresses: map[string]string{"node-1": "agent-1:8501"},
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+	c := &Controller{cfg: cfg, consulInstance: consul.Adapter{}}
+
+	ready := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	nodes := []v1.Node{
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+			Status: v1.NodeStatus{
+				Conditions: ready,
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.1"}},
+			},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "node-2"},
+			Status: v1.NodeStatus{
+				Conditions: ready,
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.2"}},
+			},
+		},
+	}
+	svc := &v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service", Namespace: "default", UID: "uid"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+
+	registrations := c.toRegistrations(svc, c.nodesToAddresses(nodes, nil), true, false)
+	assert.Len(t, registrations, 2)
+
+	var agents = make(map[string]string)
+	for _, r := range registrations {
+		assert.Equal(t, r.agentAddress, r.service.Address, "service should be registered with address of node")
+		agents[r.nodeName] = c.getConsulAgent(r).Config.Address
+	}
+	assert.Equal(t, "agent-1:8501", agents["node-1"], "overridden agent of node should be used")
+	assert.Equal(t, "192.168.0.2:8500", agents["node-2"], "address of node should be used")
+}
+
+func TestGetConsulAgentLoadBalancer(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:                 "kubernetes",
+			ConsulScheme:           "http",
+			ConsulPort:             "8500",
+			RegisterMode:           config.RegisterNodeMode,
+			ClusterIPConsulAddress: "consul.local",
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+	c := &Controller{cfg: cfg, consulInstance: consul.Adapter{}}
+
+	svc := &v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service", Namespace: "default", UID: "uid"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+		Status: v1.ServiceStatus{
+			LoadBalancer: v1.LoadBalancerStatus{
+				Ingress: []v1.LoadBalancerIngress{{IP: "1.2.3.4"}, {Hostname: "lb.example.com"}},
+			},
+		},
+	}
+
+	registrations, err := c.getRegistrations(svc)
+	assert.NoError(t, err)
+	assert.Len(t, registrations, 2)
+	for _, r := range registrations {
+		assert.True(t, r.agentFixed, "load balancer should be registered in fixed agent")
+		assert.Equal(t, "consul.local:8500", c.getConsulAgent(r).Config.Address, "wrong agent")
+		assert.Equal(t, 80, r.service.Port, "wrong port")
+	}
+	assert.Equal(t, "1.2.3.4", registrations[0].service.Address)
+	assert.Equal(t, "lb.example.com", registrations[1].service.Address)
+}
+
+func TestUsesFixedAgent(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			RegisterMode: config.RegisterNodeMode,
+		},
+	}
+	c := &Controller{cfg: cfg}
+
+	services := []v1.Service{
+		{Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort}},
+		{Spec: v1.ServiceSpec{Type: v1.ServiceTypeClusterIP}},
+	}
+	assert.False(t, c.usesFixedAgent(services), "fixed agent shouldn't be used")
+
+	services[1].ObjectMeta.Annotations = map[string]string{ConsulRegisterClusterIPAnnotation: "true"}
+	assert.True(t, c.usesFixedAgent(services), "fixed agent should be used by service with cluster IP annotation")
+
+	services[1].ObjectMeta.Annotations = nil
+	services[0].Spec.Type = v1.ServiceTypeLoadBalancer
+	assert.True(t, c.usesFixedAgent(services), "fixed agent should be used by load balancer")
+
+	cfg.Controller.RegisterClusterIP = true
+	assert.True(t, c.usesFixedAgent(nil), "fixed agent should be used if registration of cluster IP is enabled")
+}
+
+func TestGetMissingServices(t *testing.T) {
+	t.Parallel()
+
+	registered := map[string][]string{
+		"deleted": {"deleted-80"},
+		"changed": {"changed-80", "changed-8080"},
+		"unknown": {"unknown-80"},
+	}
+	expected := map[string]map[string]bool{
+		"changed": {"changed-8080": true, "changed-9090": true},
+		"unknown": nil,
+	}
+
+	missing := getMissingServices(registered, expected)
+	sort.Strings(missing)
+	assert.Equal(t, []string{"changed-80", "deleted-80"}, missing)
+}
+
+func TestUsesExternalNode(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ExternalNodeName: "external",
+		},
+	}
+	c := &Controller{cfg: cfg}
+
+	services := []v1.Service{
+		{Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort}},
+		{Spec: v1.ServiceSpec{Type: v1.ServiceTypeExternalName}},
+	}
+	assert.False(t, c.usesExternalNode(services), "external node shouldn't be used without external name")
+
+	services[1].Spec.ExternalName = "example.com"
+	assert.True(t, c.usesExternalNode(services), "external node should be used by ExternalName service")
+}
+
+func TestSimulate(t *testing.T) {
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:                 "kubernetes",
+			RegisterMode:           config.RegisterSingleMode,
+			NodeAddressTypes:       []string{string(v1.NodeInternalIP)},
+			ClusterIPConsulAddress: "localhost",
+			ConsulAddress:          "localhost",
+			ExternalNodeName:       "kubernetes-external",
+			NodeUnhealthyAction:    config.NodeUnhealthyRemove,
+		},
+	}
+
+	ready := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	nodes := []v1.Node{
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+			Status: v1.NodeStatus{
+				Conditions: ready,
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.1"}},
+			},
+		},
+		{
+			ObjectMeta: v1.ObjectMeta{Name: "node-2"},
+			Spec:       v1.NodeSpec{Unschedulable: true},
+			Status: v1.NodeStatus{
+				Conditions: ready,
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.2"}},
+			},
+		},
+	}
+	enabled := map[string]string{ConsulRegisterEnabledAnnotation: "true"}
+	newService := func(annotations map[string]string, spec v1.ServiceSpec) *v1.Service {
+		return &v1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "nginx", Namespace: "default", UID: "uid", Annotations: annotations},
+			Spec:       spec,
+		}
+	}
+	ports := []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}}
+
+	clusterIPEnabled := map[string]string{ConsulRegisterEnabledAnnotation: "true", ConsulRegisterClusterIPAnnotation: "true"}
+
+	tests := []struct {
+		name      string
+		svc       *v1.Service
+		headless  config.HeadlessMode
+		addresses []string
+	}{
+		{
+			name:      "node port",
+			svc:       newService(enabled, v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: ports}),
+			addresses: []string{"192.168.0.1:30080"},
+		},
+		{
+			name:      "external IPs",
+			svc:       newService(enabled, v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: ports, ExternalIPs: []string{"1.2.3.4"}}),
+			addresses: []string{"1.2.3.4:80"},
+		},
+		{
+			name: "cluster IP enabled by annotation",
+			svc: newService(map[string]string{ConsulRegisterEnabledAnnotation: "true", ConsulRegisterClusterIPAnnotation: "true"},
+				v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: "10.96.0.10", Ports: ports}),
+			addresses: []string{"10.96.0.10:80"},
+		},
+		{
+			name: "cluster IP",
+			svc:  newService(enabled, v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: "10.96.0.10", Ports: ports}),
+		},
+		{
+			name:      "external name",
+			svc:       newService(enabled, v1.ServiceSpec{Type: v1.ServiceTypeExternalName, ExternalName: "example.com", Ports: ports}),
+			addresses: []string{"example.com:80"},
+		},
+		{
+			name: "disabled service",
+			svc:  newService(nil, v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: ports}),
+		},
+		{
+			name:      "cluster IP with empty type",
+			svc:       newService(clusterIPEnabled, v1.ServiceSpec{ClusterIP: "10.96.0.10", Ports: ports}),
+			addresses: []string{"10.96.0.10:80"},
+		},
+		{
+			name:     "headless service skipped",
+			svc:      newService(clusterIPEnabled, v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: v1.ClusterIPNone, Ports: ports}),
+			headless: config.HeadlessSkipMode,
+		},
+		{
+			name:     "headless service with endpoints",
+			svc:      newService(clusterIPEnabled, v1.ServiceSpec{Type: v1.ServiceTypeClusterIP, ClusterIP: v1.ClusterIPNone, Ports: ports}),
+			headless: config.HeadlessEndpointsMode,
+		},
+	}
+
+	for _, test := range tests {
+		cfg.Controller.ClusterIPHeadless = test.headless
+		services, err := Simulate(test.svc, nodes, cfg)
+		assert.NoError(t, err, test.name)
+
+		var addresses []string
+		for _, service := range services {
+			addresses = append(addresses, fmt.Sprintf("%s:%d", service.Address, service.Port))
+			assert.Equal(t, "nginx", service.Name, test.name)
+			assert.Contains(t, service.Tags, "kubernetes", test.name)
+		}
+		assert.Equal(t, test.addresses, addresses, test.name)
+	}
+}
+
+func TestServiceID(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:       "kubernetes",
+			RegisterMode: config.RegisterSingleMode,
+		},
+	}
+	c := &Controller{cfg: cfg}
+
+	tests := []struct {
+		name  string
+		ports []v1.ServicePort
+		ids   []string
+	}{
+		{
+			name:  "tcp",
+			ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 53, NodePort: 30053}},
+			ids:   []string{"dns-uid-1.2.3.4-53"},
+		},
+		{
+			name:  "default protocol",
+			ports: []v1.ServicePort{{Port: 53, NodePort: 30053}},
+			ids:   []string{"dns-uid-1.2.3.4-53"},
+		},
+		{
+			name: "udp with tcp",
+			ports: []v1.ServicePort{
+				{Protocol: v1.ProtocolTCP, Port: 53, NodePort: 30053},
+				{Protocol: v1.ProtocolUDP, Port: 53, NodePort: 30053},
+			},
+			ids: []string{"dns-uid-1.2.3.4-53", "dns-uid-1.2.3.4-53-udp"},
+		},
+		{
+			name:  "udp only",
+			ports: []v1.ServicePort{{Protocol: v1.ProtocolUDP, Port: 53, NodePort: 30053}},
+			ids:   []string{"dns-uid-1.2.3.4-53"},
+		},
+		{
+			name: "sctp with tcp on other port",
+			ports: []v1.ServicePort{
+				{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080},
+				{Protocol: protocolSCTP, Port: 53, NodePort: 30053},
+			},
+			ids: []string{"dns-uid-1.2.3.4-80", "dns-uid-1.2.3.4-53"},
+		},
+	}
+
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "dns", Namespace: "default", UID: "uid"},
+			Spec:       v1.ServiceSpec{Type: v1.ServiceTypeNodePort, Ports: test.ports, ExternalIPs: []string{"1.2.3.4"}},
+		}
+		registrations, err := c.getRegistrations(svc)
+		assert.NoError(t, err, test.name)
+
+		var ids []string
+		for _, r := range registrations {
+			ids = append(ids, r.service.ID)
+		}
+		assert.Equal(t, test.ids, ids, test.name)
+	}
+}
+
+func TestGetRegistrationsLocalTraffic(t *testing.T) {
+	unhealthyNodes = make(map[string]string)
+
+	ready := []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}
+	var nodes []v1.Node
+	for i := 1; i <= 3; i++ {
+		nodes = append(nodes, v1.Node{
+			ObjectMeta: v1.ObjectMeta{Name: fmt.Sprintf("node-%d", i)},
+			Status: v1.NodeStatus{
+				Conditions: ready,
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: fmt.Sprintf("192.168.0.%d", i)}},
+			},
+		})
+	}
+	node1, node2 := "node-1", "node-2"
+	endpoints := &v1.Endpoints{
+		ObjectMeta: v1.ObjectMeta{Name: "service", Namespace: "default"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1", NodeName: &node1}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2", NodeName: &node2}},
+			Ports:             []v1.EndpointPort{{Port: 8080, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:           "kubernetes",
+			RegisterMode:     config.RegisterSingleMode,
+			NodeAddressTypes: []string{string(v1.NodeInternalIP)},
+		},
+	}
+	c := &Controller{
+		clientset: fake.NewSimpleClientset(&v1.NodeList{Items: nodes}, endpoints),
+		cfg:       cfg,
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		nodeNames   []string
+	}{
+		{
+			name:      "cluster traffic",
+			nodeNames: []string{"node-1", "node-2", "node-3"},
+		},
+		{
+			name:        "local traffic",
+			annotations: map[string]string{ExternalTrafficAnnotation: "OnlyLocal"},
+			nodeNames:   []string{"node-1"},
+		},
+		{
+			name:        "local traffic with new value",
+			annotations: map[string]string{ExternalTrafficAnnotation: "Local"},
+			nodeNames:   []string{"node-1"},
+		},
+		{
+			name:        "global traffic",
+			annotations: map[string]string{ExternalTrafficAnnotation: "Global"},
+			nodeNames:   []string{"node-1", "node-2", "node-3"},
+		},
+	}
+
+	for _, test := range tests {
+		svc := &v1.Service{
+			ObjectMeta: v1.ObjectMeta{Name: "service", Namespace: "default", UID: "uid", Annotations: test.annotations},
+			Spec: v1.ServiceSpec{
+				Type:  v1.ServiceTypeNodePort,
+				Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+			},
+		}
+		registrations, err := c.getRegistrations(svc)
+		assert.NoError(t, err, test.name)
+
+		var nodeNames []string
+		for _, r := range registrations {
+			nodeNames = append(nodeNames, r.nodeName)
+			assert.Equal(t, 30080, r.service.Port, test.name)
+		}
+		sort.Strings(nodeNames)
+		assert.Equal(t, test.nodeNames, nodeNames, test.name)
+	}
+}
+
+func TestEndpointsUpdate(t *testing.T) {
+	t.Parallel()
+
+	clientset := fake.NewSimpleClientset()
+	c := &Controller{
+		clientset: clientset,
+		cfg:       &config.Config{Controller: &config.ControllerConfig{}},
+		services:  cache.NewStore(cache.MetaNamespaceKeyFunc),
+	}
+	endpoints := &v1.Endpoints{ObjectMeta: v1.ObjectMeta{Name: "service", Namespace: "default"}}
+
+	assert.NoError(t, c.endpointsUpdate(endpoints), "endpoints of unknown service should be skipped")
+
+	c.services.Add(&v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "service",
+			Namespace:   "default",
+			Annotations: map[string]string{ConsulRegisterEnabledAnnotation: "true"},
+		},
+		Spec: v1.ServiceSpec{Type: v1.ServiceTypeNodePort},
+	})
+	assert.NoError(t, c.endpointsUpdate(endpoints), "endpoints of cluster traffic service should be skipped")
+	assert.Empty(t, clientset.Actions(), "service should be taken from the store")
+}
+
+func TestGetNodeAddress(t *testing.T) {
+	t.Parallel()
+
+	internal := v1.NodeAddress{Type: v1.NodeInternalIP, Address: "192.168.0.1"}
+	external := v1.NodeAddress{Type: v1.NodeExternalIP, Address: "1.2.3.4"}
+	hostname := v1.NodeAddress{Type: v1.NodeHostName, Address: "node-1.example.com"}
+
+	tests := []struct {
+		name            string
+		addressTypes    []v1.NodeAddressType
+		addresses       []v1.NodeAddress
+		address         string
+		ok              bool
+		taggedAddresses map[string]string
+	}{
+		{
+			name:            "internal IP",
+			addressTypes:    []v1.NodeAddressType{v1.NodeInternalIP, v1.NodeExternalIP},
+			addresses:       []v1.NodeAddress{hostname, external, internal},
+			address:         "192.168.0.1",
+			ok:              true,
+			taggedAddresses: map[string]string{"lan": "192.168.0.1", "wan": "1.2.3.4"},
+		},
+		{
+			name:            "external IP",
+			addressTypes:    []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP},
+			addresses:       []v1.NodeAddress{internal, external},
+			address:         "1.2.3.4",
+			ok:              true,
+			taggedAddresses: map[string]string{"lan": "192.168.0.1", "wan": "1.2.3.4"},
+		},
+		{
+			name:            "hostname",
+			addressTypes:    []v1.NodeAddressType{v1.NodeHostName},
+			addresses:       []v1.NodeAddress{internal, hostname},
+			address:         "node-1.example.com",
+			ok:              true,
+			taggedAddresses: map[string]string{"lan": "192.168.0.1"},
+		},
+		{
+			name:            "fallback to next type",
+			addressTypes:    []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeHostName, v1.NodeInternalIP},
+			addresses:       []v1.NodeAddress{internal},
+			address:         "192.168.0.1",
+			ok:              true,
+			taggedAddresses: map[string]string{"lan": "192.168.0.1"},
+		},
+		{
+			name:            "first address of type",
+			addressTypes:    []v1.NodeAddressType{v1.NodeExternalIP},
+			addresses:       []v1.NodeAddress{external, {Type: v1.NodeExternalIP, Address: "5.6.7.8"}},
+			address:         "1.2.3.4",
+			ok:              true,
+			taggedAddresses: map[string]string{"wan": "1.2.3.4"},
+		},
+		{
+			name:         "missing type",
+			addressTypes: []v1.NodeAddressType{v1.NodeExternalIP},
+			addresses:    []v1.NodeAddress{internal, hostname},
+		},
+	}
+
+	for _, test := range tests {
+		var addressTypes []string
+		for _, addressType := range test.addressTypes {
+			addressTypes = append(addressTypes, string(addressType))
+		}
+		c := &Controller{cfg: &config.Config{Controller: &config.ControllerConfig{NodeAddressTypes: addressTypes}}}
+		node := &v1.Node{
+			ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+			Status:     v1.NodeStatus{Addresses: test.addresses},
+		}
+
+		address, ok := c.getNodeAddress(node)
+		assert.Equal(t, test.ok, ok, test.name)
+		if !ok {
+			continue
+		}
+		assert.Equal(t, test.address, address.address, test.name)
+		assert.Equal(t, "node-1", address.nodeName, test.name)
+		assert.Equal(t, test.taggedAddresses, address.taggedAddresses, test.name)
+	}
+
+	// Tagged addresses of node are used by services together with node port
+	c := &Controller{cfg: &config.Config{Controller: &config.ControllerConfig{
+		K8sTag:           "kubernetes",
+		NodeAddressTypes: []string{string(v1.NodeExternalIP)},
+	}}}
+	address, ok := c.getNodeAddress(&v1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+		Status:     v1.NodeStatus{Addresses: []v1.NodeAddress{internal, external}},
+	})
+	assert.True(t, ok)
+	svc := &v1.Service{
+		ObjectMeta: v1.ObjectMeta{Name: "service", Namespace: "default", UID: "uid"},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	registrations := c.toRegistrations(svc, []targetAddress{address}, true, false)
+	assert.Len(t, registrations, 1)
+	assert.Equal(t, "1.2.3.4", registrations[0].service.Address)
+	assert.Equal(t, map[string]consulapi.ServiceAddress{
+		"lan": {Address: "192.168.0.1", Port: 30080},
+		"wan": {Address: "1.2.3.4", Port: 30080},
+	}, registrations[0].service.TaggedAddresses)
+}
+
+// fakeAgent is Consul Agent which records requests to register, deregister services and change their maintenance mode
+type fakeAgent struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (a *fakeAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	switch dir, id := path.Split(r.URL.Path); dir {
+	case "/v1/agent/service/":
+		var service consulapi.AgentServiceRegistration
+		json.NewDecoder(r.Body).Decode(&service)
+		a.requests = append(a.requests, fmt.Sprintf("register %s", service.ID))
+	case "/v1/agent/service/deregister/":
+		a.requests = append(a.requests, fmt.Sprintf("deregister %s", id))
+	case "/v1/agent/service/maintenance/":
+		a.requests = append(a.requests, fmt.Sprintf("maintenance %s %s", id, r.URL.Query().Get("enable")))
+	}
+}
+
+// flush returns requests recorded since the last call
+func (a *fakeAgent) flush() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	requests := a.requests
+	a.requests = nil
+	return requests
+}
+
+// newFakeAgentController returns controller of `single` mode which uses fake Consul Agent
+// and fake Kubernetes cluster with given objects
+func newFakeAgentController(t *testing.T, agent *fakeAgent, objects ...runtime.Object) *Controller {
+	server := httptest.NewServer(agent)
+	t.Cleanup(server.Close)
+
+	address, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	// Registered services and health of nodes are kept in package
+	addedServices = make(map[types.UID]map[string]*registration)
+	unhealthyNodes = make(map[string]string)
+
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			K8sTag:           "kubernetes",
+			ConsulAddress:    address.Hostname(),
+			ConsulPort:       address.Port(),
+			ConsulScheme:     "http",
+			RegisterMode:     config.RegisterSingleMode,
+			NodeAddressTypes: []string{string(v1.NodeInternalIP)},
+		},
+		Consul: consulapi.DefaultConfig(),
+	}
+	return &Controller{
+		clientset:      fake.NewSimpleClientset(objects...),
+		consulInstance: consul.Adapter{},
+		cfg:            cfg,
+		mutex:          &sync.Mutex{},
+	}
+}
+
+func TestNodeUpdate(t *testing.T) {
+	newNode := func(status v1.ConditionStatus) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: v1.ObjectMeta{Name: "node-1"},
+			Status: v1.NodeStatus{
+				Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+				Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "192.168.0.1"}},
+			},
+		}
+	}
+	svc := &v1.Service{
+		ObjectMeta: v1.ObjectMeta{
+			Name:        "service",
+			Namespace:   "default",
+			UID:         "uid",
+			Annotations: map[string]string{ConsulRegisterEnabledAnnotation: "true"},
+		},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeNodePort,
+			Ports: []v1.ServicePort{{Protocol: v1.ProtocolTCP, Port: 80, NodePort: 30080}},
+		},
+	}
+	serviceID := "service-uid-192.168.0.1-30080"
+
+	t.Run("maintenance", func(t *testing.T) {
+		agent := &fakeAgent{}
+		c := newFakeAgentController(t, agent, newNode(v1.ConditionTrue), svc)
+		c.cfg.Controller.NodeUnhealthyAction = config.NodeUnhealthyMaintenance
+
+		assert.NoError(t, c.eventAddFunc(svc))
+		assert.Equal(t, []string{"register " + serviceID}, agent.flush())
+
+		assert.NoError(t, c.nodeUpdate(newNode(v1.ConditionFalse)))
+		assert.Equal(t, []string{"maintenance " + serviceID + " true"}, agent.flush(), "service of not ready node should be in maintenance")
+		assert.Contains(t, unhealthyNodes, "node-1")
+
+		// Service of unhealthy node is still registered
+		assert.NoError(t, c.eventUpdateFunc(svc))
+		assert.Empty(t, agent.flush(), "service in maintenance shouldn't be registered again")
+
+		assert.NoError(t, c.nodeUpdate(newNode(v1.ConditionTrue)))
+		assert.Equal(t, []string{"maintenance " + serviceID + " false"}, agent.flush(), "maintenance should be disabled on ready node")
+		assert.NotContains(t, unhealthyNodes, "node-1")
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		agent := &fakeAgent{}
+		c := newFakeAgentController(t, agent, newNode(v1.ConditionTrue), svc)
+		c.cfg.Controller.NodeUnhealthyAction = config.NodeUnhealthyRemove
+
+		assert.NoError(t, c.eventAddFunc(svc))
+		assert.Equal(t, []string{"register " + serviceID}, agent.flush())
+
+		_, err := c.clientset.CoreV1().Nodes().Update(newNode(v1.ConditionFalse))
+		assert.NoError(t, err)
+		assert.NoError(t, c.nodeUpdate(newNode(v1.ConditionFalse)))
+		assert.Equal(t, []string{"deregister " + serviceID}, agent.flush(), "service of not ready node should be removed")
+		assert.Empty(t, addedServices)
+
+		_, err = c.clientset.CoreV1().Nodes().Update(newNode(v1.ConditionTrue))
+		assert.NoError(t, err)
+		assert.NoError(t, c.nodeUpdate(newNode(v1.ConditionTrue)))
+		assert.Equal(t, []string{"register " + serviceID}, agent.flush(), "service should be registered again on ready node")
+	})
+}
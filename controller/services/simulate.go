@@ -0,0 +1,60 @@
+package services
+
+import (
+	"github.com/golang/glog"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/utils"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Simulate returns Consul services which would be registered for given Kubernetes Service,
+// without access to Kubernetes and Consul. Addresses of `NodePort` services are taken from given nodes.
+// Local external traffic policy and headless services in `endpoints` mode are not taken into account.
+// Empty type of service is `ClusterIP`, the same as API server sets by default.
+func Simulate(svc *v1.Service, nodes []v1.Node, cfg *config.Config) ([]*consulapi.AgentServiceRegistration, error) {
+	var registrations []*registration
+	var err error
+
+	c := &Controller{cfg: cfg}
+
+	if !isRegisterEnabled(svc) {
+		return nil, nil
+	}
+
+	if svc.Spec.Type == "" {
+		defaulted := *svc
+		defaulted.Spec.Type = v1.ServiceTypeClusterIP
+		svc = &defaulted
+	}
+
+	switch serviceType := svc.Spec.Type; {
+	case serviceType == v1.ServiceTypeClusterIP && c.isClusterIPEnabled(svc) && svc.Spec.ClusterIP == v1.ClusterIPNone &&
+		cfg.Controller.ClusterIPHeadless == config.HeadlessEndpointsMode:
+		glog.Warningf("Service %s is headless, it can't be simulated", svc.ObjectMeta.Name)
+		return nil, nil
+	case serviceType == v1.ServiceTypeNodePort && len(svc.Spec.ExternalIPs) == 0:
+		var filteredNodes []v1.Node
+		for _, node := range nodes {
+			if cfg.Controller.RegisterMode == config.RegisterNodeMode && cfg.Controller.ConsulNodeSelector != "" &&
+				!utils.HasLabel(node.ObjectMeta.Labels, cfg.Controller.ConsulNodeSelector) {
+				continue
+			}
+			filteredNodes = append(filteredNodes, node)
+		}
+		registrations = c.toRegistrations(svc, c.nodesToAddresses(filteredNodes, nil), true, false)
+	default:
+		registrations, err = c.getRegistrations(svc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var services []*consulapi.AgentServiceRegistration
+	for _, r := range registrations {
+		services = append(services, r.service)
+	}
+	return services, nil
+}
@@ -1,8 +1,33 @@
 package services
 
+import (
+	consulapi "github.com/hashicorp/consul/api"
+)
+
 // FactoryAdapter has a method to work with Controller resources.
 type FactoryAdapter interface {
 	Watch()
 	Sync() error
 	Clean() error
 }
+
+// targetAddress describes address under which Kubernetes Service is reachable.
+type targetAddress struct {
+	address string
+	// nodeName is a name of node which the address belongs to
+	nodeName string
+	// taggedAddresses keeps alternative addresses of node, i.e. `lan` and `wan`
+	taggedAddresses map[string]string
+}
+
+// registration describes Consul service and Consul Agent which the service is registered in.
+type registration struct {
+	service *consulapi.AgentServiceRegistration
+	// agentAddress is an address of node, or address of Consul Agent if agentFixed is set
+	agentAddress string
+	agentFixed   bool
+	// catalogNode is a name of node in Consul catalog, if set the service is registered in catalog
+	catalogNode string
+	// nodeName is a name of Kubernetes node which the service is registered for
+	nodeName string
+}
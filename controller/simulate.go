@@ -0,0 +1,199 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/golang/glog"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/controller/endpoints"
+	"github.com/tczekajlo/kube-consul-register/controller/pods"
+	"github.com/tczekajlo/kube-consul-register/controller/services"
+
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/pkg/util/yaml"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Manifests keeps Kubernetes objects read from manifest files
+type Manifests struct {
+	Pods       []v1.Pod
+	Services   []v1.Service
+	Endpoints  []v1.Endpoints
+	Nodes      []v1.Node
+	ConfigMaps []v1.ConfigMap
+}
+
+// SimulationResult describes Consul services which would be registered for Kubernetes object
+type SimulationResult struct {
+	Kind      string                                `json:"kind"`
+	Namespace string                                `json:"namespace"`
+	Name      string                                `json:"name"`
+	Error     string                                `json:"error,omitempty"`
+	Services  []*consulapi.AgentServiceRegistration `json:"services"`
+}
+
+// ReadManifests reads Kubernetes objects from YAML and JSON files in given directory and its subdirectories.
+// Objects of kinds other than Pod, Service, Endpoints, Node and ConfigMap are omitted.
+func ReadManifests(dir string) (*Manifests, error) {
+	var files []string
+	manifests := &Manifests{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+
+		decoder := yaml.NewYAMLOrJSONDecoder(f, 4096)
+		for {
+			var document json.RawMessage
+			err := decoder.Decode(&document)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Can't decode %s: %s", file, err)
+			}
+			if err := manifests.add(document); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("Can't decode %s: %s", file, err)
+			}
+		}
+		f.Close()
+	}
+	return manifests, nil
+}
+
+func (m *Manifests) add(document json.RawMessage) error {
+	var object struct {
+		Kind  string            `json:"kind"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if len(document) == 0 || string(document) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(document, &object); err != nil {
+		return err
+	}
+
+	switch object.Kind {
+	case "Pod":
+		var pod v1.Pod
+		if err := json.Unmarshal(document, &pod); err != nil {
+			return err
+		}
+		m.Pods = append(m.Pods, pod)
+	case "Service":
+		var svc v1.Service
+		if err := json.Unmarshal(document, &svc); err != nil {
+			return err
+		}
+		m.Services = append(m.Services, svc)
+	case "Endpoints":
+		var endpoint v1.Endpoints
+		if err := json.Unmarshal(document, &endpoint); err != nil {
+			return err
+		}
+		m.Endpoints = append(m.Endpoints, endpoint)
+	case "Node":
+		var node v1.Node
+		if err := json.Unmarshal(document, &node); err != nil {
+			return err
+		}
+		m.Nodes = append(m.Nodes, node)
+	case "ConfigMap":
+		var configMap v1.ConfigMap
+		if err := json.Unmarshal(document, &configMap); err != nil {
+			return err
+		}
+		m.ConfigMaps = append(m.ConfigMaps, configMap)
+	case "List":
+		for _, item := range object.Items {
+			if err := m.add(item); err != nil {
+				return err
+			}
+		}
+	default:
+		glog.V(2).Infof("Object of kind %s is omitted", object.Kind)
+	}
+	return nil
+}
+
+// ConfigMap returns data of ConfigMap with given namespace and name
+func (m *Manifests) ConfigMap(namespace string, name string) (map[string]string, bool) {
+	for _, configMap := range m.ConfigMaps {
+		if configMap.ObjectMeta.Namespace == namespace && configMap.ObjectMeta.Name == name {
+			return configMap.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Simulate converts Kubernetes objects into Consul services without access to Kubernetes and Consul.
+// Pods, Services and Endpoints are converted regardless of `register_source` option. Tags of services are sorted.
+func Simulate(manifests *Manifests, cfg *config.Config) []SimulationResult {
+	var results []SimulationResult
+
+	for _, pod := range manifests.Pods {
+		consulServices, err := pods.Simulate(&pod, cfg)
+		results = append(results, newSimulationResult("Pod", pod.ObjectMeta, consulServices, err))
+	}
+
+	for _, svc := range manifests.Services {
+		consulServices, err := services.Simulate(&svc, manifests.Nodes, cfg)
+		results = append(results, newSimulationResult("Service", svc.ObjectMeta, consulServices, err))
+	}
+
+	for _, endpoint := range manifests.Endpoints {
+		var owner *v1.Service
+		for i, svc := range manifests.Services {
+			if svc.ObjectMeta.Namespace == endpoint.ObjectMeta.Namespace && svc.ObjectMeta.Name == endpoint.ObjectMeta.Name {
+				owner = &manifests.Services[i]
+			}
+		}
+		consulServices, err := endpoints.Simulate(&endpoint, owner, cfg)
+		results = append(results, newSimulationResult("Endpoints", endpoint.ObjectMeta, consulServices, err))
+	}
+	return results
+}
+
+func newSimulationResult(kind string, meta v1.ObjectMeta, consulServices []*consulapi.AgentServiceRegistration, err error) SimulationResult {
+	result := SimulationResult{
+		Kind:      kind,
+		Namespace: meta.Namespace,
+		Name:      meta.Name,
+		Services:  consulServices,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	for _, service := range consulServices {
+		sort.Strings(service.Tags)
+	}
+	if result.Services == nil {
+		result.Services = []*consulapi.AgentServiceRegistration{}
+	}
+	return result
+}
@@ -0,0 +1,140 @@
+package controller
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tczekajlo/kube-consul-register/config"
+)
+
+const multiDocumentManifest = `
+apiVersion: v1
+kind: Service
+metadata:
+  name: nginx
+  namespace: default
+  annotations:
+    consul.register/enabled: "true"
+spec:
+  type: NodePort
+  ports:
+  - port: 80
+    nodePort: 30080
+---
+apiVersion: v1
+kind: Deployment
+metadata:
+  name: omitted
+---
+---
+apiVersion: v1
+kind: Endpoints
+metadata:
+  name: nginx
+  namespace: default
+subsets:
+- addresses:
+  - ip: 10.0.0.1
+    targetRef:
+      kind: Pod
+      name: nginx-1
+      uid: uid-1
+  ports:
+  - port: 80
+`
+
+const listManifest = `{
+  "apiVersion": "v1",
+  "kind": "List",
+  "items": [
+    {
+      "apiVersion": "v1",
+      "kind": "Node",
+      "metadata": {"name": "node-1"},
+      "status": {
+        "conditions": [{"type": "Ready", "status": "True"}],
+        "addresses": [{"type": "InternalIP", "address": "192.168.0.1"}]
+      }
+    },
+    {
+      "apiVersion": "v1",
+      "kind": "ConfigMap",
+      "metadata": {"name": "config", "namespace": "default"},
+      "data": {"k8s_tag": "k8s"}
+    },
+    {
+      "apiVersion": "v1",
+      "kind": "Pod",
+      "metadata": {"name": "pod", "namespace": "default"}
+    }
+  ]
+}`
+
+func TestReadManifests(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"services.yaml":    multiDocumentManifest,
+		"sub/list.json":    listManifest,
+		"ignored.txt":      "not a manifest",
+		"sub/empty.yml":    "",
+		"sub/comment.yaml": "# only comment\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+
+	manifests, err := ReadManifests(dir)
+	assert.NoError(t, err)
+	assert.Len(t, manifests.Services, 1)
+	assert.Len(t, manifests.Endpoints, 1)
+	assert.Len(t, manifests.Nodes, 1)
+	assert.Len(t, manifests.Pods, 1)
+	assert.Len(t, manifests.ConfigMaps, 1)
+
+	data, ok := manifests.ConfigMap("default", "config")
+	assert.True(t, ok, "ConfigMap should be found")
+	assert.Equal(t, "k8s", data["k8s_tag"])
+	_, ok = manifests.ConfigMap("default", "other")
+	assert.False(t, ok, "ConfigMap shouldn't be found")
+
+	cfg, err := config.LoadData(data)
+	assert.NoError(t, err)
+
+	results := Simulate(manifests, cfg)
+	assert.Len(t, results, 3)
+
+	var kinds []string
+	for _, result := range results {
+		kinds = append(kinds, result.Kind)
+		assert.Empty(t, result.Error, result.Kind)
+		assert.NotNil(t, result.Services, "services should be empty list instead of null")
+	}
+	assert.Equal(t, []string{"Pod", "Service", "Endpoints"}, kinds)
+
+	// Service is registered with address of node from List
+	assert.Len(t, results[1].Services, 1)
+	assert.Equal(t, "192.168.0.1", results[1].Services[0].Address)
+	assert.Equal(t, 30080, results[1].Services[0].Port)
+
+	// Endpoints are enabled by annotation of their Service
+	assert.Len(t, results[2].Services, 1)
+	assert.Equal(t, "nginx-1-80", results[2].Services[0].ID)
+	assert.Contains(t, results[2].Services[0].Tags, "k8s")
+}
+
+func TestReadManifestsInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "invalid.json"), []byte(`{"kind": "Service", "spec": {"ports": "80"}}`), 0644))
+
+	_, err := ReadManifests(dir)
+	assert.Error(t, err)
+}
@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tczekajlo/kube-consul-register/config"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// AgentAddressAnnotation is a name of annotation or label of node which overrides address of Consul Agent running on the node.
+// Both are supported, the annotation takes precedence over the label. Only the annotation can contain port or URL,
+// since value of label can't contain `:`.
+const AgentAddressAnnotation = "consul.register/agent.address"
+
+// refreshInterval is a period of time after which addresses of Consul Agents are listed again
+const refreshInterval = 30 * time.Second
+
+// missRefreshInterval is the minimum period of time between listings of Consul Agents
+// caused by a node which has no known Consul Agent
+const missRefreshInterval = 5 * time.Second
+
+// Resolver finds address of Consul Agent running on Kubernetes node. Address is taken from
+// `consul.register/agent.address` annotation or label of node, or according to `consul_agent_discovery` option.
+// It finds also InternalIP address of Kubernetes node.
+type Resolver struct {
+	clientset kubernetes.Interface
+	cfg       *config.Config
+	mutex     sync.Mutex
+	// addresses keeps address of Consul Agent by name of node
+	addresses map[string]string
+	// nodeAddresses keeps InternalIP address by name of node
+	nodeAddresses map[string]string
+	// nodes keeps names of nodes from the last listing
+	nodes     map[string]bool
+	refreshed time.Time
+}
+
+// New returns Resolver of Consul Agents
+func New(clientset kubernetes.Interface, cfg *config.Config) *Resolver {
+	return &Resolver{
+		clientset:     clientset,
+		cfg:           cfg,
+		addresses:     make(map[string]string),
+		nodeAddresses: make(map[string]string),
+		nodes:         make(map[string]bool),
+	}
+}
+
+// AgentAddress returns address of Consul Agent running on Kubernetes node with given name,
+// as host, host:port or URL. It returns false if the address can't be found.
+func (r *Resolver) AgentAddress(nodeName string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.addresses[nodeName]
+	// Listed node without annotation or label is known in `node-name` discovery, it has no address
+	if !ok && r.cfg.Controller.ConsulAgentDiscovery == config.AgentDiscoveryNodeName {
+		ok = r.nodes[nodeName]
+	}
+	r.refresh(ok)
+
+	if address, ok := r.addresses[nodeName]; ok {
+		return address, true
+	}
+	if r.cfg.Controller.ConsulAgentDiscovery != config.AgentDiscoveryNodeName {
+		glog.Warningf("Can't find Consul Agent on node %s with %s discovery", nodeName, r.cfg.Controller.ConsulAgentDiscovery)
+	}
+	return "", false
+}
+
+// NodeAddress returns InternalIP address of Kubernetes node with given name.
+// It returns false if the address can't be found.
+func (r *Resolver) NodeAddress(nodeName string) (string, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	_, ok := r.nodeAddresses[nodeName]
+	r.refresh(ok)
+
+	address, ok := r.nodeAddresses[nodeName]
+	return address, ok
+}
+
+// needsRefresh checks if addresses listed at given time are outdated, or if the searched node
+// isn't known and they haven't been listed recently
+func needsRefresh(refreshed time.Time, now time.Time, known bool) bool {
+	elapsed := now.Sub(refreshed)
+	return elapsed > refreshInterval || (!known && elapsed > missRefreshInterval)
+}
+
+// refresh lists addresses again if they're outdated, or if the searched node isn't known
+// and they haven't been listed recently
+func (r *Resolver) refresh(known bool) {
+	now := time.Now()
+	if !needsRefresh(r.refreshed, now, known) {
+		return
+	}
+
+	nodes, err := r.clientset.CoreV1().Nodes().List(v1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Can't list nodes: %s", err)
+	} else {
+		r.nodeAddresses = nodesToAddresses(nodes.Items)
+		r.nodes = make(map[string]bool)
+		for _, node := range nodes.Items {
+			r.nodes[node.ObjectMeta.Name] = true
+		}
+		addresses, err := r.list(nodes.Items)
+		if err != nil {
+			glog.Errorf("Can't discover Consul Agents: %s", err)
+		} else {
+			r.addresses = addresses
+		}
+	}
+	r.refreshed = now
+}
+
+// list returns addresses of Consul Agents by name of node, pods of Consul Agents are listed
+// only in `daemonset` discovery
+func (r *Resolver) list(nodes []v1.Node) (map[string]string, error) {
+	var pods []v1.Pod
+	if r.cfg.Controller.ConsulAgentDiscovery == config.AgentDiscoveryDaemonSet {
+		podList, err := r.clientset.CoreV1().Pods(r.cfg.Controller.ConsulAgentNamespace).List(v1.ListOptions{
+			LabelSelector: r.cfg.Controller.ConsulAgentSelector,
+		})
+		if err != nil {
+			return nil, err
+		}
+		pods = podList.Items
+	}
+	return agentAddresses(r.cfg.Controller.ConsulAgentDiscovery, nodes, pods), nil
+}
+
+// agentAddresses returns addresses of Consul Agents by name of node according to discovery mode,
+// address given by node annotation or label takes precedence over discovered one.
+// No address is discovered in `node-name` discovery, name of node is used by caller instead.
+func agentAddresses(mode config.AgentDiscoveryMode, nodes []v1.Node, pods []v1.Pod) map[string]string {
+	var addresses = make(map[string]string)
+	switch mode {
+	case config.AgentDiscoveryDaemonSet:
+		addresses = podsToAddresses(pods)
+	case config.AgentDiscoveryInternalIP:
+		addresses = nodesToAddresses(nodes)
+	}
+
+	for nodeName, address := range nodesToOverrides(nodes) {
+		addresses[nodeName] = address
+	}
+	return addresses
+}
+
+// podsToAddresses returns IP addresses of running pods of Consul Agents by name of node
+func podsToAddresses(pods []v1.Pod) map[string]string {
+	var addresses = make(map[string]string)
+	for _, pod := range pods {
+		if pod.Status.Phase != v1.PodRunning || pod.Status.PodIP == "" || pod.Spec.NodeName == "" {
+			continue
+		}
+		addresses[pod.Spec.NodeName] = pod.Status.PodIP
+	}
+	return addresses
+}
+
+// nodesToAddresses returns internal IP addresses of nodes by name of node
+func nodesToAddresses(nodes []v1.Node) map[string]string {
+	var addresses = make(map[string]string)
+	for _, node := range nodes {
+		for _, address := range node.Status.Addresses {
+			if address.Type == v1.NodeInternalIP {
+				addresses[node.ObjectMeta.Name] = address.Address
+				break
+			}
+		}
+	}
+	return addresses
+}
+
+// nodesToOverrides returns addresses of Consul Agents given by annotation or label of node
+// by name of node, annotation takes precedence over label
+func nodesToOverrides(nodes []v1.Node) map[string]string {
+	var addresses = make(map[string]string)
+	for _, node := range nodes {
+		if value, ok := node.ObjectMeta.Annotations[AgentAddressAnnotation]; ok && value != "" {
+			addresses[node.ObjectMeta.Name] = value
+		} else if value, ok := node.ObjectMeta.Labels[AgentAddressAnnotation]; ok && value != "" {
+			addresses[node.ObjectMeta.Name] = value
+		}
+	}
+	return addresses
+}
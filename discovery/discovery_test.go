@@ -0,0 +1,259 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func newNode(name string, internalIP string, annotations map[string]string, labels map[string]string) v1.Node {
+	return v1.Node{
+		ObjectMeta: v1.ObjectMeta{Name: name, Annotations: annotations, Labels: labels},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: name},
+				{Type: v1.NodeInternalIP, Address: internalIP},
+			},
+		},
+	}
+}
+
+func newPod(name string, nodeName string, phase v1.PodPhase, podIP string) v1.Pod {
+	return v1.Pod{
+		ObjectMeta: v1.ObjectMeta{Name: name, Namespace: "consul", Labels: map[string]string{"app": "consul"}},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+		Status:     v1.PodStatus{Phase: phase, PodIP: podIP},
+	}
+}
+
+func TestPodsToAddresses(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		pods     []v1.Pod
+		expected map[string]string
+	}{
+		{
+			name:     "running pods",
+			pods:     []v1.Pod{newPod("consul-1", "node-1", v1.PodRunning, "10.0.0.1"), newPod("consul-2", "node-2", v1.PodRunning, "10.0.0.2")},
+			expected: map[string]string{"node-1": "10.0.0.1", "node-2": "10.0.0.2"},
+		},
+		{
+			name:     "pending pod",
+			pods:     []v1.Pod{newPod("consul-1", "node-1", v1.PodPending, "10.0.0.1")},
+			expected: map[string]string{},
+		},
+		{
+			name:     "pod without IP",
+			pods:     []v1.Pod{newPod("consul-1", "node-1", v1.PodRunning, "")},
+			expected: map[string]string{},
+		},
+		{
+			name:     "unscheduled pod",
+			pods:     []v1.Pod{newPod("consul-1", "", v1.PodRunning, "10.0.0.1")},
+			expected: map[string]string{},
+		},
+		{
+			name:     "no pods",
+			expected: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, podsToAddresses(test.pods), test.name)
+	}
+}
+
+func TestAgentAddresses(t *testing.T) {
+	t.Parallel()
+
+	nodes := []v1.Node{
+		newNode("node-1", "192.168.0.1", nil, nil),
+		newNode("node-2", "192.168.0.2", map[string]string{AgentAddressAnnotation: "https://10.1.0.2:8501"},
+			map[string]string{AgentAddressAnnotation: "10.2.0.2"}),
+		newNode("node-3", "192.168.0.3", nil, map[string]string{AgentAddressAnnotation: "10.2.0.3"}),
+		newNode("node-4", "192.168.0.4", map[string]string{AgentAddressAnnotation: ""}, nil),
+	}
+	pods := []v1.Pod{
+		newPod("consul-1", "node-1", v1.PodRunning, "10.0.0.1"),
+		newPod("consul-2", "node-2", v1.PodRunning, "10.0.0.2"),
+	}
+
+	tests := []struct {
+		name     string
+		mode     config.AgentDiscoveryMode
+		expected map[string]string
+	}{
+		{
+			// Name of node is used for nodes without overridden address
+			name: "node-name",
+			mode: config.AgentDiscoveryNodeName,
+			expected: map[string]string{
+				"node-2": "https://10.1.0.2:8501",
+				"node-3": "10.2.0.3",
+			},
+		},
+		{
+			name: "daemonset",
+			mode: config.AgentDiscoveryDaemonSet,
+			expected: map[string]string{
+				"node-1": "10.0.0.1",
+				"node-2": "https://10.1.0.2:8501",
+				"node-3": "10.2.0.3",
+			},
+		},
+		{
+			name: "internal-ip",
+			mode: config.AgentDiscoveryInternalIP,
+			expected: map[string]string{
+				"node-1": "192.168.0.1",
+				"node-2": "https://10.1.0.2:8501",
+				"node-3": "10.2.0.3",
+				"node-4": "192.168.0.4",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, agentAddresses(test.mode, nodes, pods), test.name)
+	}
+}
+
+func TestNodesToOverrides(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		labels      map[string]string
+		expected    map[string]string
+	}{
+		{
+			name:        "annotation",
+			annotations: map[string]string{AgentAddressAnnotation: "10.0.0.1:8501"},
+			expected:    map[string]string{"node": "10.0.0.1:8501"},
+		},
+		{
+			name:     "label",
+			labels:   map[string]string{AgentAddressAnnotation: "10.0.0.2"},
+			expected: map[string]string{"node": "10.0.0.2"},
+		},
+		{
+			name:        "annotation over label",
+			annotations: map[string]string{AgentAddressAnnotation: "10.0.0.1:8501"},
+			labels:      map[string]string{AgentAddressAnnotation: "10.0.0.2"},
+			expected:    map[string]string{"node": "10.0.0.1:8501"},
+		},
+		{
+			name:        "empty annotation",
+			annotations: map[string]string{AgentAddressAnnotation: ""},
+			labels:      map[string]string{AgentAddressAnnotation: "10.0.0.2"},
+			expected:    map[string]string{"node": "10.0.0.2"},
+		},
+		{
+			name:     "no override",
+			expected: map[string]string{},
+		},
+	}
+
+	for _, test := range tests {
+		nodes := []v1.Node{newNode("node", "192.168.0.1", test.annotations, test.labels)}
+		assert.Equal(t, test.expected, nodesToOverrides(nodes), test.name)
+	}
+}
+
+func TestNeedsRefresh(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		known    bool
+		expected bool
+	}{
+		{"known node listed recently", time.Second, true, false},
+		{"unknown node listed recently", time.Second, false, false},
+		{"known node listed before miss interval", 10 * time.Second, true, false},
+		{"unknown node listed before miss interval", 10 * time.Second, false, true},
+		{"known node listed before refresh interval", 31 * time.Second, true, true},
+		{"unknown node listed before refresh interval", 31 * time.Second, false, true},
+		{"never listed", now.Sub(time.Time{}), true, true},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, needsRefresh(now.Add(-test.elapsed), now, test.known), test.name)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	t.Parallel()
+
+	node := newNode("node-1", "192.168.0.1", nil, nil)
+	pod := newPod("consul-1", "node-1", v1.PodRunning, "10.0.0.1")
+	clientset := fake.NewSimpleClientset(&v1.NodeList{Items: []v1.Node{node}}, &v1.PodList{Items: []v1.Pod{pod}})
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAgentDiscovery: config.AgentDiscoveryDaemonSet,
+			ConsulAgentNamespace: "consul",
+			ConsulAgentSelector:  "app=consul",
+		},
+	}
+	r := New(clientset, cfg)
+
+	address, ok := r.AgentAddress("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1", address)
+	address, ok = r.NodeAddress("node-1")
+	assert.True(t, ok)
+	assert.Equal(t, "192.168.0.1", address)
+	assert.Len(t, clientset.Actions(), 2, "nodes and pods should be listed once")
+
+	// Unknown node doesn't cause listing until the miss interval passes
+	_, ok = r.AgentAddress("node-2")
+	assert.False(t, ok)
+	assert.Len(t, clientset.Actions(), 2, "unknown node shouldn't be listed again immediately")
+
+	r.refreshed = time.Now().Add(-10 * time.Second)
+	_, ok = r.AgentAddress("node-1")
+	assert.True(t, ok)
+	assert.Len(t, clientset.Actions(), 2, "known node shouldn't be listed again before refresh interval")
+	_, ok = r.AgentAddress("node-2")
+	assert.False(t, ok)
+	assert.Len(t, clientset.Actions(), 4, "unknown node should be listed again after miss interval")
+
+	r.refreshed = time.Now().Add(-time.Minute)
+	_, ok = r.NodeAddress("node-1")
+	assert.True(t, ok)
+	assert.Len(t, clientset.Actions(), 6, "addresses should be listed again after refresh interval")
+}
+
+func TestResolverNodeName(t *testing.T) {
+	t.Parallel()
+
+	node := newNode("node-1", "192.168.0.1", nil, nil)
+	clientset := fake.NewSimpleClientset(&v1.NodeList{Items: []v1.Node{node}})
+	cfg := &config.Config{
+		Controller: &config.ControllerConfig{
+			ConsulAgentDiscovery: config.AgentDiscoveryNodeName,
+		},
+	}
+	r := New(clientset, cfg)
+
+	_, ok := r.AgentAddress("node-1")
+	assert.False(t, ok, "name of node should be used by caller")
+	assert.Len(t, clientset.Actions(), 1, "nodes should be listed once")
+
+	r.refreshed = time.Now().Add(-10 * time.Second)
+	_, ok = r.AgentAddress("node-1")
+	assert.False(t, ok)
+	assert.Len(t, clientset.Actions(), 1, "listed node without override shouldn't be listed again before refresh interval")
+	_, ok = r.AgentAddress("node-2")
+	assert.False(t, ok)
+	assert.Len(t, clientset.Actions(), 2, "unknown node should be listed again after miss interval")
+}
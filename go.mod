@@ -9,12 +9,13 @@ require (
 	github.com/coreos/go-oidc v0.0.0-20160818215358-5644a2f50e2d // indirect
 	github.com/docker/distribution v2.6.2+incompatible // indirect
 	github.com/emicklei/go-restful v0.0.0-20160814184150-89ef8af493ab // indirect
+	github.com/ghodss/yaml v1.0.0
 	github.com/go-openapi/jsonpointer v0.0.0-20160704185906-46af16f9f7b1 // indirect
 	github.com/go-openapi/jsonreference v0.0.0-20160704190145-13c6e3589ad9 // indirect
 	github.com/go-openapi/spec v0.0.0-20160808142527-6aced65f8501 // indirect
 	github.com/go-openapi/swag v0.0.0-20160704191624-1d0bd113de87 // indirect
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
-	github.com/hashicorp/consul/api v1.3.0
+	github.com/hashicorp/consul/api v1.12.0
 	github.com/hashicorp/go-cleanhttp v0.5.1
 	github.com/howeyc/gopass v0.0.0-20160826175423-3ca23474a7c7 // indirect
 	github.com/imdario/mergo v0.0.0-20141206190957-6633656539c1 // indirect
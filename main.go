@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,6 +17,7 @@ import (
 	"github.com/tczekajlo/kube-consul-register/config"
 	"github.com/tczekajlo/kube-consul-register/consul"
 	"github.com/tczekajlo/kube-consul-register/controller"
+	"github.com/tczekajlo/kube-consul-register/discovery"
 	"github.com/tczekajlo/kube-consul-register/metrics"
 	"github.com/tczekajlo/kube-consul-register/utils"
 	"k8s.io/client-go/kubernetes"
@@ -34,20 +36,27 @@ var (
 	watchNamespace       = flag.String("watch-namespace", v1.NamespaceAll, "namespace to watch for Pods. Default is to watch all namespaces")
 	kubeconfig           = flag.String("kubeconfig", "./kubeconfig", "absolute path to the kubeconfig file")
 	configMap            = flag.String("configmap", "default/kube-consul-register-config", "name of the ConfigMap that containes the custom configuration to use")
-	consulSecret         = flag.String("consul-secret", "", "name of the secret containing the consul token, e.g. default/consul. Key must be consul_token.")
+	consulSecret         = flag.String("consul-secret", "", "name of the secret containing the consul token, e.g. default/consul. Key must be consul_token. The secret is read again periodically for rotation of the token")
+	consulTokenFile      = flag.String("consul-token-file", "", "path to the file containing the consul token, e.g. mounted secret. The file is read again periodically for rotation of the token")
 	inClusterConfig      = flag.Bool("in-cluster", false, "use in-cluster config. Use always in case when controller is running on Kubernetes cluster")
 	syncInterval         = flag.Duration("sync-interval", 120*time.Second, "time in seconds, what period of time will be done synchronization")
 	cleanInterval        = flag.Duration("clean-interval", 1800*time.Second, "time in seconds, what period of time will be done cleaning of inactive services")
 	metricsListenAddress = flag.String("metrics-listen-address", ":8080", "the address to listen on for HTTP requests.")
 	versionFlag          = flag.Bool("version", false, "print version end exit")
+	dryRun               = flag.Bool("dry-run", false, "record and log operations on Consul instead of executing them. The plan is available by /plan endpoint")
 )
 
 func init() {
 	// Metrics have to be registered to be exposed
 	prometheus.MustRegister(metrics.ConsulFailure)
 	prometheus.MustRegister(metrics.ConsulSuccess)
+	prometheus.MustRegister(metrics.ConsulRetries)
+	prometheus.MustRegister(metrics.ConsulBreakerState)
+	prometheus.MustRegister(metrics.ConsulTokenRotation)
 	prometheus.MustRegister(metrics.PodFailure)
 	prometheus.MustRegister(metrics.PodSuccess)
+	prometheus.MustRegister(metrics.DriftRepaired)
+	prometheus.MustRegister(metrics.CleanLimitExceeded)
 	prometheus.MustRegister(metrics.FuncDuration)
 }
 
@@ -59,6 +68,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Simulate subcommand works without Kubernetes cluster
+	if flag.Arg(0) == "simulate" {
+		os.Exit(runSimulate(flag.Args()[1:]))
+	}
+
 	glog.Infof("Using build: %v", VERSION)
 
 	var err error
@@ -96,6 +110,18 @@ func main() {
 		glog.Infof("Current configuration: Controller: %#v, Consul: %#v", cfg.Controller, cfg.Consul)
 	}
 
+	if cfg == nil {
+		cfg, err = config.LoadData(map[string]string{})
+		if err != nil {
+			glog.Fatalf("Unable to load default configuration: %v", err)
+		}
+		glog.Infof("Using default configuration: Controller: %#v, Consul: %#v", cfg.Controller, cfg.Consul)
+	}
+
+	if *consulSecret != "" && *consulTokenFile != "" {
+		glog.Fatal("Only one of -consul-secret and -consul-token-file can be given")
+	}
+
 	if *consulSecret != "" {
 		namespace, name, err := utils.ParseNsName(*consulSecret)
 		if err != nil {
@@ -105,12 +131,43 @@ func main() {
 		if err != nil {
 			glog.Fatalf("can't get secret %s: %s", *consulSecret, err)
 		}
-		if value, ok := secretResource.Data["consul_token"]; ok {
-			cfg.Controller.ConsulToken = string(value)
+		if value, ok := secretResource.Data[consulTokenKey]; ok {
+			cfg.Controller.ConsulToken = strings.TrimSpace(string(value))
 		}
+		go watchTokenSecret(clientset, namespace, name, cfg.Controller.ConsulToken)
 	}
+
+	if *consulTokenFile != "" {
+		token, err := readTokenFile(*consulTokenFile)
+		if err != nil {
+			glog.Fatalf("can't read consul token from file %s: %s", *consulTokenFile, err)
+		}
+		cfg.Controller.ConsulToken = token
+		go watchTokenFile(*consulTokenFile, token)
+	}
+
 	//Consul instance
 	consulInstance := consul.Adapter{}
+	if cfg.Controller.RegisterMode == config.RegisterNodeMode || cfg.Controller.RegisterMode == config.RegisterPodMode {
+		// Consul Agents of nodes are found by annotations of nodes and discovery strategy
+		glog.Infof("Consul Agents are discovered with %s strategy", cfg.Controller.ConsulAgentDiscovery)
+		consulInstance.Resolver = discovery.New(clientset, cfg)
+	}
+	if cfg.Controller.RegisterMode == config.RegisterCatalogMode && cfg.Controller.CatalogNodeMode == config.CatalogNodePerNode {
+		// Synthetic nodes get addresses of Kubernetes nodes
+		consulInstance.NodeResolver = discovery.New(clientset, cfg)
+	}
+
+	// Plan subcommand
+	if flag.Arg(0) == "plan" {
+		os.Exit(runPlan(clientset, consulInstance, flag.Args()[1:]))
+	}
+
+	if *dryRun {
+		glog.Info("Dry-run mode is enabled, operations on Consul are not executed")
+		cfg.Controller.DryRun = true
+		http.Handle("/plan", consul.DryRunPlan)
+	}
 
 	//Controller instance
 	ctrInstance := controller.Factory{}
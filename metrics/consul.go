@@ -20,4 +20,30 @@ var (
 		},
 		[]string{"operation", "consul_address"},
 	)
+
+	// ConsulRetries returns counter for consul_retries_total metric
+	ConsulRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "consul_retries_total",
+			Help: "Number of retried HTTP requests to Consul.",
+		},
+		[]string{"consul_address"},
+	)
+
+	// ConsulBreakerState returns gauge for consul_circuit_breaker_state metric
+	ConsulBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "consul_circuit_breaker_state",
+			Help: "State of circuit breaker of Consul Agent: 0 - closed, 1 - open, 2 - half-open.",
+		},
+		[]string{"consul_address"},
+	)
+
+	// ConsulTokenRotation returns gauge for consul_token_last_rotation_timestamp_seconds metric
+	ConsulTokenRotation = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "consul_token_last_rotation_timestamp_seconds",
+			Help: "Time of the last rotation of Consul ACL token as Unix timestamp.",
+		},
+	)
 )
@@ -21,6 +21,24 @@ var (
 		[]string{"operation"},
 	)
 
+	// DriftRepaired returns counter for drift_repaired_total metric
+	DriftRepaired = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "drift_repaired_total",
+			Help: "Number of repaired differences between Consul services and Kubernetes",
+		},
+		[]string{"field"},
+	)
+
+	// CleanLimitExceeded returns counter for clean_limit_exceeded_total metric
+	CleanLimitExceeded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "clean_limit_exceeded_total",
+			Help: "Number of cleaning runs stopped because of exceeded limit of deregistrations",
+		},
+		[]string{"source"},
+	)
+
 	// FuncDuration returns summary for controller_function_duration_seconds metric
 	FuncDuration = prometheus.NewSummaryVec(
 		prometheus.SummaryOpts{
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"github.com/tczekajlo/kube-consul-register/consul"
+	"github.com/tczekajlo/kube-consul-register/controller"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Exit codes of `plan` subcommand
+const (
+	planInSync = 0
+	planDrift  = 1
+	planError  = 2
+)
+
+// runPlan runs synchronization and cleaning once in dry-run mode and prints registrations which
+// would be added, updated and removed in Consul. Removals which cleaning holds back are printed
+// as held and count as drift. It returns exit code of `plan` subcommand.
+func runPlan(clientset *kubernetes.Clientset, consulInstance consul.Adapter, args []string) int {
+	planFlags := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := planFlags.String("output", "text", "output format of plan: text, json or yaml")
+	planFlags.Parse(args)
+
+	if *output != "text" && *output != "json" && *output != "yaml" {
+		fmt.Fprintf(os.Stderr, "Wrong value of -output flag. Permitted values: text|json|yaml, is %s\n", *output)
+		return planError
+	}
+	cfg.Controller.DryRun = true
+
+	ctrInstance := controller.Factory{}
+	ctr := ctrInstance.New(clientset, consulInstance, cfg, *watchNamespace)
+
+	if err := ctr.Sync(); err != nil {
+		glog.Errorf("Unable to syncing: %s", err)
+		return planError
+	}
+	if err := ctr.Clean(); err != nil {
+		glog.Errorf("Unable to cleaning to inactive services: %s", err)
+		return planError
+	}
+
+	var changes = []consul.Operation{}
+	for _, operation := range consul.DryRunPlan.Operations() {
+		if operation.Change != consul.ChangeNone {
+			changes = append(changes, operation)
+		}
+	}
+
+	if err := printPlan(os.Stdout, changes, *output); err != nil {
+		fmt.Fprintf(os.Stderr, "Can't print plan: %s\n", err)
+		return planError
+	}
+
+	if len(changes) > 0 {
+		return planDrift
+	}
+	return planInSync
+}
+
+func printPlan(w io.Writer, changes []consul.Operation, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(changes)
+	case "yaml":
+		data, err := yaml.Marshal(changes)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+
+	var count = make(map[string]int)
+	for _, operation := range changes {
+		count[operation.Change]++
+
+		sign := "~"
+		switch operation.Change {
+		case consul.ChangeAdd:
+			sign = "+"
+		case consul.ChangeRemove:
+			sign = "-"
+		case consul.ChangeHeld:
+			sign = "!"
+		}
+
+		line := fmt.Sprintf("%s %s %s", sign, operation.Operation, operation.ServiceID)
+		if operation.Change == consul.ChangeHeld {
+			line = fmt.Sprintf("%s %s (held) %s", sign, operation.Operation, operation.ServiceID)
+		}
+		if operation.Service != nil {
+			line = fmt.Sprintf("%s (%s) %s:%d", line, operation.Service.Name, operation.Service.Address, operation.Service.Port)
+		}
+		line = fmt.Sprintf("%s, consul: %s", line, operation.ConsulAddress)
+		if operation.Node != "" {
+			line = fmt.Sprintf("%s, node: %s", line, operation.Node)
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	_, err := fmt.Fprintf(w, "Plan: %d to add, %d to update, %d to remove, %d held.\n",
+		count[consul.ChangeAdd], count[consul.ChangeUpdate], count[consul.ChangeRemove], count[consul.ChangeHeld])
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ghodss/yaml"
+	"github.com/tczekajlo/kube-consul-register/config"
+	"github.com/tczekajlo/kube-consul-register/controller"
+	"github.com/tczekajlo/kube-consul-register/utils"
+)
+
+// runSimulate converts Kubernetes objects from manifest files into Consul services and prints them.
+// Configuration is taken from ConfigMap given by `-configmap` flag if it's found among manifests.
+// It returns exit code of `simulate` subcommand, which is not zero if any object can't be converted.
+func runSimulate(args []string) int {
+	simulateFlags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	manifestsDir := simulateFlags.String("manifests", ".", "directory with Kubernetes manifests (YAML or JSON)")
+	output := simulateFlags.String("output", "yaml", "output format of services: json or yaml")
+	simulateFlags.Parse(args)
+
+	if *output != "json" && *output != "yaml" {
+		fmt.Fprintf(os.Stderr, "Wrong value of -output flag. Permitted values: json|yaml, is %s\n", *output)
+		return 2
+	}
+
+	manifests, err := controller.ReadManifests(*manifestsDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't read manifests: %s\n", err)
+		return 2
+	}
+
+	var data map[string]string
+	if *configMap != "" {
+		namespace, name, err := utils.ParseNsName(*configMap)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ConfigMap: %s\n", err)
+			return 2
+		}
+		data, _ = manifests.ConfigMap(namespace, name)
+	}
+	simulateConfig, err := config.LoadData(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to load configuration: %s\n", err)
+		return 2
+	}
+
+	results := controller.Simulate(manifests, simulateConfig)
+
+	var out []byte
+	if *output == "json" {
+		out, err = json.MarshalIndent(results, "", "  ")
+		out = append(out, '\n')
+	} else {
+		out, err = yaml.Marshal(results)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Can't print services: %s\n", err)
+		return 2
+	}
+	os.Stdout.Write(out)
+
+	for _, result := range results {
+		if result.Error != "" {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/tczekajlo/kube-consul-register/consul"
+	"k8s.io/client-go/kubernetes"
+)
+
+// tokenFileInterval is a period of time after which the file or Secret with Consul ACL token is read again
+const tokenFileInterval = 10 * time.Second
+
+// consulTokenKey is a key of Secret which contains Consul ACL token
+const consulTokenKey = "consul_token"
+
+// readTokenFile returns Consul ACL token read from file
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// watchTokenFile reads the file with Consul ACL token periodically and applies the token
+// to all Consul clients when it has changed, e.g. after update of mounted Secret
+func watchTokenFile(path string, token string) {
+	for {
+		time.Sleep(tokenFileInterval)
+
+		newToken, err := readTokenFile(path)
+		if err != nil {
+			glog.Errorf("Can't read Consul token from file %s: %s", path, err)
+			continue
+		}
+		if newToken == "" || newToken == token {
+			continue
+		}
+		glog.Infof("Consul token in file %s has changed", path)
+		token = newToken
+		consul.SetToken(token)
+	}
+}
+
+// watchTokenSecret gets the Secret with Consul ACL token periodically and applies the token
+// to all Consul clients when it has changed. The Secret is read the same way as the file
+// with token, so only `get` permission on the Secret is needed.
+func watchTokenSecret(clientset kubernetes.Interface, namespace string, name string, token string) {
+	for {
+		time.Sleep(tokenFileInterval)
+
+		secret, err := clientset.CoreV1().Secrets(namespace).Get(name)
+		if err != nil {
+			glog.Errorf("Can't get secret %s/%s: %s", namespace, name, err)
+			continue
+		}
+		value, ok := secret.Data[consulTokenKey]
+		if !ok {
+			glog.Warningf("Secret %s/%s doesn't contain %s key", namespace, name, consulTokenKey)
+			continue
+		}
+		newToken := strings.TrimSpace(string(value))
+		if newToken == "" || newToken == token {
+			continue
+		}
+		glog.Infof("Consul token in secret %s/%s has changed", namespace, name)
+		token = newToken
+		consul.SetToken(token)
+	}
+}
@@ -2,7 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"k8s.io/client-go/pkg/api/v1"
 )
 
 // ParseNsName parses input and returns namespace name and ConfigMap name.
@@ -57,3 +62,76 @@ func HasLabel(labels map[string]string, searchLabel string) bool {
 	}
 	return false
 }
+
+// ProtocolSuffix returns suffix of ID of Consul service registered for port with given number and protocol,
+// tcpPorts are numbers of TCP ports registered together with the port. The protocol is added as suffix only
+// for ports other than TCP whose number is used by TCP port as well, so services registered before
+// support of other protocols keep their IDs.
+func ProtocolSuffix(port int32, protocol v1.Protocol, tcpPorts map[int32]bool) string {
+	if protocol == "" || protocol == v1.ProtocolTCP || !tcpPorts[port] {
+		return ""
+	}
+	return fmt.Sprintf("-%s", strings.ToLower(string(protocol)))
+}
+
+// ParseWeights parses weights of Consul service given in format `<passing>[,<warning>]`.
+// If warning weight is omitted then it's equal to 1.
+func ParseWeights(input string) (*consulapi.AgentWeights, error) {
+	values := strings.Split(input, ",")
+	if len(values) > 2 {
+		return nil, fmt.Errorf("invalid format (passing[,warning]) found in '%v'", input)
+	}
+
+	passing, err := strconv.Atoi(strings.TrimSpace(values[0]))
+	if err != nil || passing < 1 {
+		return nil, fmt.Errorf("invalid passing weight found in '%v', it must be greater than 0", input)
+	}
+
+	warning := 1
+	if len(values) == 2 {
+		warning, err = strconv.Atoi(strings.TrimSpace(values[1]))
+		if err != nil || warning < 0 {
+			return nil, fmt.Errorf("invalid warning weight found in '%v', it must not be negative", input)
+		}
+	}
+
+	return &consulapi.AgentWeights{Passing: passing, Warning: warning}, nil
+}
+
+// Orphans counts consecutive runs of cleaning in which Consul services are missing in Kubernetes cluster.
+type Orphans map[string]int
+
+// Update counts given services as missing in the current run, forgets services which aren't missing anymore
+// and returns sorted list of services which have been missing in at least minRuns consecutive runs.
+func (o Orphans) Update(missing []string, minRuns int) []string {
+	current := make(map[string]bool)
+	for _, serviceID := range missing {
+		current[serviceID] = true
+		o[serviceID]++
+	}
+
+	var orphaned []string
+	for serviceID, runs := range o {
+		if !current[serviceID] {
+			delete(o, serviceID)
+			continue
+		}
+		if runs >= minRuns {
+			orphaned = append(orphaned, serviceID)
+		}
+	}
+	sort.Strings(orphaned)
+	return orphaned
+}
+
+// IsDeregistrationLimitExceeded checks whether number of deregistrations exceeds the maximum count
+// or the maximum ratio of all services. Zero value of a limit means that the limit is disabled.
+func IsDeregistrationLimitExceeded(deregistrations, total, maxCount int, maxRatio float64) bool {
+	if maxCount > 0 && deregistrations > maxCount {
+		return true
+	}
+	if maxRatio > 0 && total > 0 && float64(deregistrations)/float64(total) > maxRatio {
+		return true
+	}
+	return false
+}
@@ -56,3 +56,49 @@ func TestHasLabel(t *testing.T) {
 	assert.True(t, HasLabel(labels, "pod=selector"), "HasLabel should be true")
 	assert.False(t, HasLabel(labels, ""), "HasLabel should be false")
 }
+
+func TestParseWeights(t *testing.T) {
+	t.Parallel()
+
+	weights, err := ParseWeights("10")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, weights.Passing, "they should be equal")
+	assert.Equal(t, 1, weights.Warning, "they should be equal")
+
+	weights, err = ParseWeights("5, 0")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, weights.Passing, "they should be equal")
+	assert.Equal(t, 0, weights.Warning, "they should be equal")
+
+	_, err = ParseWeights("0")
+	assert.Error(t, err, "an error was expected")
+	_, err = ParseWeights("1,-1")
+	assert.Error(t, err, "an error was expected")
+	_, err = ParseWeights("1,2,3")
+	assert.Error(t, err, "an error was expected")
+	_, err = ParseWeights("abc")
+	assert.Error(t, err, "an error was expected")
+}
+
+func TestOrphans(t *testing.T) {
+	t.Parallel()
+
+	orphans := make(Orphans)
+
+	assert.Empty(t, orphans.Update([]string{"a", "b"}, 2), "services shouldn't be orphaned after first run")
+	assert.Equal(t, []string{"a"}, orphans.Update([]string{"a"}, 2), "they should be equal")
+	assert.NotContains(t, orphans, "b", "service which isn't missing should be forgotten")
+	assert.Empty(t, orphans.Update([]string{"b"}, 2), "counter of service should start from the beginning")
+	assert.Equal(t, []string{"b", "c"}, orphans.Update([]string{"c", "b"}, 1), "they should be equal")
+}
+
+func TestIsDeregistrationLimitExceeded(t *testing.T) {
+	t.Parallel()
+
+	assert.False(t, IsDeregistrationLimitExceeded(100, 100, 0, 0), "limits should be disabled")
+	assert.False(t, IsDeregistrationLimitExceeded(5, 100, 5, 0), "limit shouldn't be exceeded")
+	assert.True(t, IsDeregistrationLimitExceeded(6, 100, 5, 0), "limit should be exceeded")
+	assert.False(t, IsDeregistrationLimitExceeded(5, 10, 0, 0.5), "limit shouldn't be exceeded")
+	assert.True(t, IsDeregistrationLimitExceeded(6, 10, 0, 0.5), "limit should be exceeded")
+	assert.False(t, IsDeregistrationLimitExceeded(0, 0, 1, 0.5), "limit shouldn't be exceeded")
+}